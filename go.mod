@@ -1,8 +1,14 @@
 module serveroute
 
-go 1.23
+go 1.23.0
 
 require (
-	github.com/gin-contrib/sse v1.1.0 // indirect
-	github.com/goccy/go-yaml v1.19.2 // indirect
+	github.com/gin-contrib/sse v1.1.0
+	github.com/goccy/go-yaml v1.19.2
+	golang.org/x/crypto v0.41.0
+)
+
+require (
+	golang.org/x/net v0.42.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
 )
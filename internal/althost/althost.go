@@ -1,17 +1,88 @@
 package althost
 
-import "net/http"
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/goccy/go-yaml"
+)
 
 type AltHost struct {
-	SSH *SSHTunnel `yaml:"ssh"`
+	SSH       *SSHTunnel       `yaml:"ssh"`
+	NativeSSH *NativeSSHTunnel `yaml:"native_ssh"` // in-process alternative to ssh
+	HTTP      *HTTPTunnel      `yaml:"http"`       // plain HTTP(S) upstream, no tunnel
+	Unix      *UnixTunnel      `yaml:"unix"`       // local UNIX socket
+	Timeout   int              `yaml:"timeout"`    // in seconds, close the tunnel once idle this long, 0 keeps it open
+}
+
+// UnmarshalYAML rejects unknown keys, so a typo does not silently drop a tunnel option.
+func (ah *AltHost) UnmarshalYAML(data []byte) error {
+	type plain AltHost
+	return yaml.UnmarshalWithOptions(data, (*plain)(ah), yaml.DisallowUnknownField())
+}
+
+// Validate checks that exactly one of ssh, native_ssh, http or unix is set.
+func (ah *AltHost) Validate() error {
+	backends := 0
+	if ah.SSH != nil {
+		backends++
+	}
+	if ah.NativeSSH != nil {
+		backends++
+	}
+	if ah.HTTP != nil {
+		backends++
+		if err := ah.HTTP.Validate(); err != nil {
+			return fmt.Errorf("http: %w", err)
+		}
+	}
+	if ah.Unix != nil {
+		backends++
+		if err := ah.Unix.Validate(); err != nil {
+			return fmt.Errorf("unix: %w", err)
+		}
+	}
+	if backends != 1 {
+		return fmt.Errorf("exactly one of ssh, native_ssh, http or unix must be set")
+	}
+	if ah.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	return nil
 }
 
 func (ah *AltHost) GetTunnel() Tunnel {
-	return ah.SSH
+	switch {
+	case ah.SSH != nil:
+		return ah.SSH
+	case ah.NativeSSH != nil:
+		return ah.NativeSSH
+	case ah.HTTP != nil:
+		return ah.HTTP
+	case ah.Unix != nil:
+		return ah.Unix
+	}
+	return nil
+}
+
+// Type returns the key the tunnel is configured under, or "" if there is none.
+func (ah *AltHost) Type() string {
+	switch {
+	case ah.SSH != nil:
+		return "ssh"
+	case ah.NativeSSH != nil:
+		return "native_ssh"
+	case ah.HTTP != nil:
+		return "http"
+	case ah.Unix != nil:
+		return "unix"
+	}
+	return ""
 }
 
 type Tunnel interface {
 	Open() error
 	Close()
 	Forward(w http.ResponseWriter, r *http.Request)
+	Status() TunnelStatus // never blocks on a connection in progress
 }
@@ -0,0 +1,46 @@
+package althost
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAltHostValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		ah      AltHost
+		wantErr string
+	}{
+		{"no backend", AltHost{}, "exactly one of"},
+		{"ssh", AltHost{SSH: &SSHTunnel{Host: "example.com"}}, ""},
+		{"native_ssh", AltHost{NativeSSH: &NativeSSHTunnel{Host: "example.com"}}, ""},
+		{"http", AltHost{HTTP: &HTTPTunnel{ForwardsTo: "http://localhost:8080"}}, ""},
+		{"unix", AltHost{Unix: &UnixTunnel{Path: "/run/app.sock"}}, ""},
+		{"ssh and http", AltHost{
+			SSH:  &SSHTunnel{Host: "example.com"},
+			HTTP: &HTTPTunnel{ForwardsTo: "http://localhost:8080"},
+		}, "exactly one of"},
+		{"ssh and native_ssh", AltHost{
+			SSH:       &SSHTunnel{Host: "example.com"},
+			NativeSSH: &NativeSSHTunnel{Host: "example.com"},
+		}, "exactly one of"},
+		{"timeout", AltHost{SSH: &SSHTunnel{Host: "example.com"}, Timeout: 300}, ""},
+		{"negative timeout", AltHost{SSH: &SSHTunnel{Host: "example.com"}, Timeout: -1}, "timeout must not be negative"},
+		{"invalid http", AltHost{HTTP: &HTTPTunnel{ForwardsTo: "localhost:8080"}}, "http: "},
+		{"invalid unix", AltHost{Unix: &UnixTunnel{}}, "unix: "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.ah.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package althost
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sync"
+)
+
+// HTTPTunnel forwards requests straight to an HTTP(S) URL, for alt hosts reachable
+// without a tunnel.
+type HTTPTunnel struct {
+	ForwardsTo            string `yaml:"forwards_to"`
+	InsecureSkipVerifyTLS bool   `yaml:"insecure_skip_verify_tls"`
+
+	direct directProxy
+}
+
+func (t *HTTPTunnel) Validate() error {
+	remoteURL, err := url.Parse(t.ForwardsTo)
+	if err != nil {
+		return fmt.Errorf("forwards_to: %w", err)
+	}
+	if (remoteURL.Scheme != "http" && remoteURL.Scheme != "https") || remoteURL.Host == "" {
+		return fmt.Errorf("forwards_to must be an http:// or https:// URL")
+	}
+	return nil
+}
+
+func (t *HTTPTunnel) Open() error {
+	return t.direct.open(func() (*httputil.ReverseProxy, error) {
+		remoteURL, err := url.Parse(t.ForwardsTo)
+		if err != nil {
+			return nil, fmt.Errorf("parsing target URL: %w", err)
+		}
+		transport := &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: t.InsecureSkipVerifyTLS,
+			},
+		}
+		return &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.SetURL(remoteURL)
+				pr.Out.Host = remoteURL.Host
+			},
+			Transport: transport,
+		}, nil
+	})
+}
+
+func (t *HTTPTunnel) Close() {
+	t.direct.close()
+}
+
+func (t *HTTPTunnel) Forward(w http.ResponseWriter, r *http.Request) {
+	t.direct.forward(w, r)
+}
+
+func (t *HTTPTunnel) Status() TunnelStatus {
+	return t.direct.status.Status()
+}
+
+// UnixTunnel forwards requests as HTTP over a local UNIX socket, such as an app published
+// by docker or podman on a socket.
+type UnixTunnel struct {
+	Path string `yaml:"path"`
+	Host string `yaml:"host"` // Host header sent over the socket, defaults to the request's
+
+	direct directProxy
+}
+
+func (t *UnixTunnel) Validate() error {
+	if t.Path == "" {
+		return fmt.Errorf("path must be set")
+	}
+	return nil
+}
+
+func (t *UnixTunnel) Open() error {
+	return t.direct.open(func() (*httputil.ReverseProxy, error) {
+		info, err := os.Stat(t.Path)
+		if err != nil {
+			return nil, err
+		}
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s is not a socket", t.Path)
+		}
+
+		socketPath := t.Path
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		}
+		host := t.Host
+		return &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				pr.Out.URL.Scheme = "http"
+				pr.Out.URL.Host = pr.In.Host
+				if host != "" {
+					pr.Out.URL.Host = host
+				}
+				pr.Out.Host = pr.Out.URL.Host
+			},
+			Transport: transport,
+		}, nil
+	})
+}
+
+func (t *UnixTunnel) Close() {
+	t.direct.close()
+}
+
+func (t *UnixTunnel) Forward(w http.ResponseWriter, r *http.Request) {
+	t.direct.forward(w, r)
+}
+
+func (t *UnixTunnel) Status() TunnelStatus {
+	return t.direct.status.Status()
+}
+
+// directProxy holds the reverse proxy of a tunnel that has no connection of its own to
+// keep up. Failed requests are recorded as the tunnel's last error.
+type directProxy struct {
+	mu     sync.Mutex
+	proxy  *httputil.ReverseProxy
+	status statusTracker
+}
+
+func (d *directProxy) open(build func() (*httputil.ReverseProxy, error)) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.proxy != nil {
+		return nil
+	}
+	d.status.connecting()
+	proxy, err := build()
+	if err != nil {
+		d.status.failed(err)
+		return err
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Request to %s failed: %v", r.URL.Host, err)
+		d.status.errored(err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	d.proxy = proxy
+	d.status.connected()
+	return nil
+}
+
+func (d *directProxy) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.proxy != nil {
+		d.proxy.Transport.(*http.Transport).CloseIdleConnections()
+		d.proxy = nil
+	}
+	d.status.closed()
+}
+
+func (d *directProxy) forward(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	proxy := d.proxy
+	d.mu.Unlock()
+
+	if proxy == nil {
+		http.Error(w, "Tunnel is closed", http.StatusBadGateway)
+		return
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,117 @@
+package althost
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTTPTunnel(t *testing.T) {
+	upstream := newUpstream(t)
+	tunnel := &HTTPTunnel{ForwardsTo: upstream.URL}
+	if err := tunnel.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	rec := get(tunnel)
+	want := "hello from " + upstream.Listener.Addr().String()
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("got %d %q, want 200 %q", rec.Code, rec.Body.String(), want)
+	}
+	if status := tunnel.Status(); status.State != TunnelConnected {
+		t.Errorf("status = %+v, want connected", status)
+	}
+
+	tunnel.Close()
+	if rec := get(tunnel); rec.Code != http.StatusBadGateway {
+		t.Errorf("got %d after Close, want 502", rec.Code)
+	}
+	if status := tunnel.Status(); status.State != TunnelClosed {
+		t.Errorf("status = %+v after Close, want closed", status)
+	}
+}
+
+func TestHTTPTunnelUnreachable(t *testing.T) {
+	upstream := newUpstream(t)
+	upstream.Close()
+
+	tunnel := &HTTPTunnel{ForwardsTo: upstream.URL}
+	if err := tunnel.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer tunnel.Close()
+
+	if rec := get(tunnel); rec.Code != http.StatusBadGateway {
+		t.Errorf("got %d, want 502", rec.Code)
+	}
+	// a failed request does not take the tunnel down
+	if status := tunnel.Status(); status.State != TunnelConnected || status.LastError == "" {
+		t.Errorf("status = %+v, want connected with the request's error", status)
+	}
+}
+
+// newUnixUpstream serves upstreamHandler on a UNIX socket and returns its path.
+func newUnixUpstream(t *testing.T) string {
+	t.Helper()
+	// not t.TempDir, whose path can exceed the socket path limit
+	dir, err := os.MkdirTemp("", "serveroute_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "app.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewUnstartedServer(upstreamHandler)
+	upstream.Listener = l
+	upstream.Start()
+	t.Cleanup(upstream.Close)
+	return path
+}
+
+func TestUnixTunnel(t *testing.T) {
+	path := newUnixUpstream(t)
+
+	tests := []struct {
+		name string
+		host string
+		want string
+	}{
+		{"request host", "", "hello from alt.test"},
+		{"host set", "app.internal", "hello from app.internal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := &UnixTunnel{Path: path, Host: tt.host}
+			if err := tunnel.Open(); err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer tunnel.Close()
+
+			if rec := get(tunnel); rec.Code != http.StatusOK || rec.Body.String() != tt.want {
+				t.Errorf("got %d %q, want 200 %q", rec.Code, rec.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestUnixTunnelNotASocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := &UnixTunnel{Path: path}
+	if err := tunnel.Open(); err == nil {
+		t.Fatal("Open succeeded on a regular file")
+	}
+	if status := tunnel.Status(); status.State != TunnelFailed {
+		t.Errorf("status = %+v, want failed", status)
+	}
+}
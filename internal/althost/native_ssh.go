@@ -0,0 +1,349 @@
+package althost
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// NativeSSHTunnel forwards requests over an in-process SSH connection, opening a
+// direct-tcpip channel per proxied connection. Unlike SSHTunnel it does not need the
+// ssh binary and does not read ssh_config.
+type NativeSSHTunnel struct {
+	Host                  string `yaml:"host"`
+	Port                  int    `yaml:"port"`          // defaults to 22
+	User                  string `yaml:"user"`          // defaults to the current user
+	IdentityFile          string `yaml:"identity_file"` // unencrypted private key, defaults to ~/.ssh/id_ed25519, id_ecdsa or id_rsa
+	KnownHostsFile        string `yaml:"known_hosts"`   // defaults to ~/.ssh/known_hosts
+	Agent                 bool   `yaml:"agent"`         // also authenticate with the agent at $SSH_AUTH_SOCK
+	ForwardsTo            string `yaml:"forwards_to"`
+	Reconnect             *bool  `yaml:"reconnect"` // defaults to true if nil
+	InsecureSkipVerifyTLS bool   `yaml:"insecure_skip_verify_tls"`
+
+	mu      sync.Mutex
+	stopped bool
+	client  *ssh.Client
+	proxy   *httputil.ReverseProxy
+	status  statusTracker
+}
+
+const nativeSSHKeepAlive = 30 * time.Second
+
+func (t *NativeSSHTunnel) shouldReconnect() bool {
+	return t.Reconnect == nil || *t.Reconnect
+}
+
+// Open connects to the SSH server. The dial happens without t.mu held, so a slow server
+// does not stall requests through an already open tunnel or Status.
+func (t *NativeSSHTunnel) Open() error {
+	t.mu.Lock()
+	if t.client != nil {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.proxy != nil && !t.shouldReconnect() {
+		t.mu.Unlock()
+		return fmt.Errorf("SSH connection to %s was lost and reconnect is disabled", t.Host)
+	}
+	t.mu.Unlock()
+
+	t.status.connecting()
+	if err := t.open(); err != nil {
+		t.status.failed(err)
+		return err
+	}
+	t.status.connected()
+	return nil
+}
+
+func (t *NativeSSHTunnel) open() error {
+	remoteURL, err := url.Parse(t.ForwardsTo)
+	if err != nil {
+		return fmt.Errorf("parsing target URL: %w", err)
+	}
+	remoteAddr := remoteURL.Host
+	if remoteURL.Port() == "" {
+		port := "80"
+		if remoteURL.Scheme == "https" {
+			port = "443"
+		}
+		remoteAddr = net.JoinHostPort(remoteURL.Hostname(), port)
+	}
+
+	client, err := t.connect()
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.client != nil {
+		// a concurrent Open won
+		client.Close()
+		return nil
+	}
+	t.stopped = false
+	t.unlockedUse(client)
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return t.dialRemote(ctx, remoteAddr)
+		},
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: t.InsecureSkipVerifyTLS,
+		},
+	}
+	t.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(remoteURL)
+			pr.Out.Host = remoteURL.Host
+		},
+		Transport: transport,
+	}
+	return nil
+}
+
+func (t *NativeSSHTunnel) addr() string {
+	port := t.Port
+	if port == 0 {
+		port = 22
+	}
+	return net.JoinHostPort(t.Host, strconv.Itoa(port))
+}
+
+// connect dials and authenticates with the SSH server. It must be called without t.mu.
+func (t *NativeSSHTunnel) connect() (*ssh.Client, error) {
+	cfg, closeAgent, err := t.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	defer closeAgent()
+	addr := t.addr()
+	client, err := ssh.Dial("tcp", addr, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", addr, err)
+	}
+	log.Printf("SSH connection to %s established", addr)
+	return client, nil
+}
+
+// unlockedUse makes client the tunnel's connection and watches it, clearing t.client
+// once it is lost so the next request reconnects.
+func (t *NativeSSHTunnel) unlockedUse(client *ssh.Client) {
+	t.client = client
+	addr := t.addr()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(nativeSSHKeepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+					client.Close()
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		err := client.Wait()
+		close(done)
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.client == client {
+			t.client = nil
+			if !t.stopped {
+				log.Printf("SSH connection to %s lost: %v", addr, err)
+				if err == nil {
+					err = fmt.Errorf("connection closed")
+				}
+				t.status.lost(err, t.shouldReconnect())
+			}
+		}
+	}()
+}
+
+// clientConfig returns the config to dial with, and a func closing the agent connection
+// once authentication is done.
+func (t *NativeSSHTunnel) clientConfig() (*ssh.ClientConfig, func(), error) {
+	home, _ := os.UserHomeDir()
+
+	username := t.User
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, nil, fmt.Errorf("finding current user: %w", err)
+		}
+		username = current.Username
+	}
+
+	knownHostsFile := expandHome(t.KnownHostsFile, home)
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading known_hosts: %w", err)
+	}
+
+	identityFiles := []string{expandHome(t.IdentityFile, home)}
+	if t.IdentityFile == "" {
+		identityFiles = nil
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			path := filepath.Join(home, ".ssh", name)
+			if _, err := os.Stat(path); err == nil {
+				identityFiles = append(identityFiles, path)
+			}
+		}
+	}
+	var signers []ssh.Signer
+	for _, path := range identityFiles {
+		key, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("reading identity_file: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		var passphraseErr *ssh.PassphraseMissingError
+		if errors.As(err, &passphraseErr) {
+			if t.IdentityFile == "" {
+				continue
+			}
+			return nil, nil, fmt.Errorf("identity_file %s is encrypted, load it into an agent and set agent: true", path)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing identity_file %s: %w", path, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) == 0 && !t.Agent {
+		return nil, nil, fmt.Errorf("no identity_file found and agent is not set")
+	}
+
+	// dialed last so no error path above leaks the connection
+	var auth []ssh.AuthMethod
+	closeAgent := func() {}
+	if t.Agent {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, nil, fmt.Errorf("agent is set but SSH_AUTH_SOCK is not")
+		}
+		// the agent signs during the handshake, so its connection stays open until then
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil, nil, fmt.Errorf("connecting to agent: %w", err)
+		}
+		closeAgent = func() { conn.Close() }
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         10 * time.Second,
+	}, closeAgent, nil
+}
+
+func expandHome(path, home string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		return filepath.Join(home, rest)
+	}
+	return path
+}
+
+// dialRemote opens a direct-tcpip channel to addr, reconnecting first if the SSH
+// connection was lost.
+func (t *NativeSSHTunnel) dialRemote(ctx context.Context, addr string) (net.Conn, error) {
+	t.mu.Lock()
+	client := t.client
+	if client == nil && (t.stopped || !t.shouldReconnect()) {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("SSH connection to %s is closed", t.Host)
+	}
+	t.mu.Unlock()
+
+	if client == nil {
+		log.Printf("Reconnecting SSH tunnel to %s...", t.Host)
+		newClient, err := t.connect()
+		if err != nil {
+			// retried on the next request
+			t.status.lost(err, true)
+			return nil, err
+		}
+
+		t.mu.Lock()
+		switch {
+		case t.stopped:
+			t.mu.Unlock()
+			newClient.Close()
+			return nil, fmt.Errorf("SSH connection to %s is closed", t.Host)
+		case t.client != nil:
+			// a concurrent request reconnected first
+			client = t.client
+			t.mu.Unlock()
+			newClient.Close()
+		default:
+			t.unlockedUse(newClient)
+			client = newClient
+			t.mu.Unlock()
+			t.status.connected()
+		}
+	}
+
+	return client.DialContext(ctx, "tcp", addr)
+}
+
+func (t *NativeSSHTunnel) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stopped = true
+	if t.client != nil {
+		t.client.Close()
+		t.client = nil
+	}
+	t.proxy = nil
+	t.status.closed()
+}
+
+func (t *NativeSSHTunnel) Status() TunnelStatus {
+	return t.status.Status()
+}
+
+func (t *NativeSSHTunnel) Forward(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	proxy := t.proxy
+	t.mu.Unlock()
+
+	if proxy == nil {
+		http.Error(w, "SSH tunnel is closed", http.StatusBadGateway)
+		return
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,352 @@
+package althost
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer is an in-process SSH server on a loopback port that accepts one client
+// key and serves direct-tcpip channels by dialing the requested address.
+type testSSHServer struct {
+	addr    string
+	hostKey ssh.Signer
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTestSSHServer(t *testing.T, authorized ssh.PublicKey) *testSSHServer {
+	t.Helper()
+
+	srv := &testSSHServer{hostKey: newSigner(t)}
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	cfg.AddHostKey(srv.hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+		srv.drop()
+	})
+	srv.addr = l.Addr().String()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, conn)
+			srv.mu.Unlock()
+			go srv.serve(conn, cfg)
+		}
+	}()
+	return srv
+}
+
+func (srv *testSSHServer) serve(conn net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChan := range chans {
+		if newChan.ChannelType() != "direct-tcpip" {
+			newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(newChan.ExtraData(), &target); err != nil {
+			newChan.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		remote, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			newChan.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := newChan.Accept()
+		if err != nil {
+			remote.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		go func() {
+			defer ch.Close()
+			defer remote.Close()
+			go io.Copy(remote, ch)
+			io.Copy(ch, remote)
+		}()
+	}
+}
+
+// drop closes every client connection, as if the network went away.
+func (srv *testSSHServer) drop() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, conn := range srv.conns {
+		conn.Close()
+	}
+	srv.conns = nil
+}
+
+func (srv *testSSHServer) knownHosts(t *testing.T) string {
+	t.Helper()
+	line := knownhosts.Line([]string{knownhosts.Normalize(srv.addr)}, srv.hostKey.PublicKey())
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(path, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	signer, err := ssh.NewSignerFromKey(newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func writeIdentity(t *testing.T, key ed25519.PrivateKey) string {
+	t.Helper()
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// upstreamHandler replies with the Host it was reached under.
+var upstreamHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "hello from %s", r.Host)
+})
+
+func newUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	upstream := httptest.NewServer(upstreamHandler)
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// newTestTunnel returns a tunnel to srv forwarding to upstream, with no identity set.
+func newTestTunnel(t *testing.T, srv *testSSHServer, upstream *httptest.Server) *NativeSSHTunnel {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(srv.addr)
+	portNum, _ := strconv.Atoi(port)
+	tunnel := &NativeSSHTunnel{
+		Host:           host,
+		Port:           portNum,
+		User:           "test",
+		KnownHostsFile: srv.knownHosts(t),
+		ForwardsTo:     upstream.URL,
+	}
+	t.Cleanup(tunnel.Close)
+	return tunnel
+}
+
+func get(tunnel Tunnel) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	tunnel.Forward(rec, httptest.NewRequest(http.MethodGet, "http://alt.test/", nil))
+	return rec
+}
+
+func TestNativeSSHTunnelIdentityFile(t *testing.T) {
+	key := newKey(t)
+	signer, _ := ssh.NewSignerFromKey(key)
+	srv := newTestSSHServer(t, signer.PublicKey())
+	upstream := newUpstream(t)
+
+	tunnel := newTestTunnel(t, srv, upstream)
+	tunnel.IdentityFile = writeIdentity(t, key)
+	if err := tunnel.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	rec := get(tunnel)
+	want := "hello from " + upstream.Listener.Addr().String()
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("got %d %q, want 200 %q", rec.Code, rec.Body.String(), want)
+	}
+	if status := tunnel.Status(); status.State != TunnelConnected || status.ConnectedSince == nil {
+		t.Errorf("status = %+v, want connected", status)
+	}
+}
+
+func TestNativeSSHTunnelAgent(t *testing.T) {
+	key := newKey(t)
+	signer, _ := ssh.NewSignerFromKey(key)
+	srv := newTestSSHServer(t, signer.PublicKey())
+	upstream := newUpstream(t)
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+	// no default identity files to fall back on
+	t.Setenv("HOME", t.TempDir())
+
+	tunnel := newTestTunnel(t, srv, upstream)
+	tunnel.Agent = true
+	if err := tunnel.Open(); err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if rec := get(tunnel); rec.Code != http.StatusOK {
+		t.Errorf("got %d %q, want 200", rec.Code, rec.Body.String())
+	}
+}
+
+func TestNativeSSHTunnelKnownHosts(t *testing.T) {
+	key := newKey(t)
+	signer, _ := ssh.NewSignerFromKey(key)
+	srv := newTestSSHServer(t, signer.PublicKey())
+	upstream := newUpstream(t)
+
+	tests := []struct {
+		name       string
+		knownHosts func() string
+		wantErr    bool
+	}{
+		{"listed", func() string { return srv.knownHosts(t) }, false},
+		{"other key", func() string {
+			line := knownhosts.Line([]string{knownhosts.Normalize(srv.addr)}, newSigner(t).PublicKey())
+			path := filepath.Join(t.TempDir(), "known_hosts")
+			os.WriteFile(path, []byte(line+"\n"), 0600)
+			return path
+		}, true},
+		{"not listed", func() string {
+			path := filepath.Join(t.TempDir(), "known_hosts")
+			os.WriteFile(path, nil, 0600)
+			return path
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tunnel := newTestTunnel(t, srv, upstream)
+			tunnel.IdentityFile = writeIdentity(t, key)
+			tunnel.KnownHostsFile = tt.knownHosts()
+
+			err := tunnel.Open()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Open error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if status := tunnel.Status(); status.State != TunnelFailed || status.LastError == "" {
+					t.Errorf("status = %+v, want failed with an error", status)
+				}
+			}
+		})
+	}
+}
+
+func TestNativeSSHTunnelReconnect(t *testing.T) {
+	key := newKey(t)
+	signer, _ := ssh.NewSignerFromKey(key)
+	srv := newTestSSHServer(t, signer.PublicKey())
+	upstream := newUpstream(t)
+
+	for _, reconnect := range []bool{true, false} {
+		t.Run(fmt.Sprintf("reconnect=%v", reconnect), func(t *testing.T) {
+			tunnel := newTestTunnel(t, srv, upstream)
+			tunnel.IdentityFile = writeIdentity(t, key)
+			tunnel.Reconnect = &reconnect
+			if err := tunnel.Open(); err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if rec := get(tunnel); rec.Code != http.StatusOK {
+				t.Fatalf("got %d before the drop, want 200", rec.Code)
+			}
+
+			srv.drop()
+			wantState := TunnelFailed
+			if reconnect {
+				wantState = TunnelReconnecting
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for tunnel.Status().State != wantState {
+				if time.Now().After(deadline) {
+					t.Fatalf("state = %s after the drop, want %s", tunnel.Status().State, wantState)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			rec := get(tunnel)
+			if !reconnect {
+				if rec.Code != http.StatusBadGateway {
+					t.Errorf("got %d after the drop, want 502", rec.Code)
+				}
+				return
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got %d %q after the drop, want 200", rec.Code, rec.Body.String())
+			}
+			if status := tunnel.Status(); status.State != TunnelConnected || status.Reconnects != 1 {
+				t.Errorf("status = %+v, want connected with 1 reconnect", status)
+			}
+		})
+	}
+}
@@ -12,23 +12,30 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
 
 type SSHTunnel struct {
-	Host                  string `yaml:"host"`
-	ForwardsTo            string `yaml:"forwards_to"`
-	Reconnect             *bool  `yaml:"reconnect"` // defaults to true if nil
-	InsecureSkipVerifyTLS bool   `yaml:"insecure_skip_verify_tls"`
+	Host                  string            `yaml:"host"`
+	Port                  int               `yaml:"port"`             // passed as -p
+	User                  string            `yaml:"user"`             // passed as -l
+	IdentityFile          string            `yaml:"identity_file"`    // passed as -i
+	ProxyJump             string            `yaml:"proxy_jump"`       // passed as -J
+	KnownHostsFile        string            `yaml:"known_hosts_file"` // passed as -o UserKnownHostsFile=
+	SSHOptions            map[string]string `yaml:"ssh_options"`      // passed as -o key=value
+	ForwardsTo            string            `yaml:"forwards_to"`
+	Reconnect             *bool             `yaml:"reconnect"` // defaults to true if nil
+	InsecureSkipVerifyTLS bool              `yaml:"insecure_skip_verify_tls"`
 
 	mu         sync.Mutex
 	stopped    bool
 	socketPath string
 	proxy      *httputil.ReverseProxy
-	cmd        *exec.Cmd
-	ctx        context.Context
-	cancel     context.CancelFunc
+	cmd        *exec.Cmd // set while the tunnel is up
+	status     statusTracker
 }
 
 func (t *SSHTunnel) unlockedShouldReconnect() bool {
@@ -42,6 +49,7 @@ func (t *SSHTunnel) unlockedShouldReconnect() bool {
 	return shouldReconnect
 }
 
+// Open starts the ssh process if it is not running. It may be called again after Close.
 func (t *SSHTunnel) Open() error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -49,46 +57,55 @@ func (t *SSHTunnel) Open() error {
 	if t.cmd != nil {
 		return nil
 	}
+	t.stopped = false
 
-	// Create temp socket file
-	socketDir, err := os.MkdirTemp("", "serveroute_tun.*")
-	if err != nil {
+	t.status.connecting()
+	if err := t.unlockedOpen(); err != nil {
+		t.status.failed(err)
 		return err
 	}
-	t.socketPath = path.Join(socketDir, "socket")
+	t.status.connected()
+	return nil
+}
 
+func (t *SSHTunnel) unlockedOpen() error {
 	// Build SSH command
 	remoteUrl, err := url.Parse(t.ForwardsTo)
 	if err != nil {
 		return fmt.Errorf("parsing target URL: %w", err)
 	}
 
-	// Create context for command
-	t.ctx, t.cancel = context.WithCancel(context.Background())
-	t.cmd = exec.CommandContext(t.ctx, "ssh",
-		"-N",
-		"-o", "ServerAliveInterval=60",
-		"-o", "ServerAliveCountMax=3",
-		"-L", fmt.Sprintf("%s:%s", t.socketPath, remoteUrl.Host),
-		t.Host,
-	)
+	// Create temp socket file
+	socketDir, err := os.MkdirTemp("", "serveroute_tun.*")
+	if err != nil {
+		return err
+	}
+	socketPath := path.Join(socketDir, "socket")
+	t.socketPath = socketPath
+
+	cmd := exec.Command("ssh", t.args(remoteUrl.Host)...)
 
 	// Start SSH process
-	if err := t.cmd.Start(); err != nil {
+	if err := cmd.Start(); err != nil {
+		os.RemoveAll(socketDir)
 		return fmt.Errorf("failed to start SSH tunnel: %w", err)
 	}
+	exited := make(chan struct{})
+	go t.wait(cmd, exited)
 
 	// Wait for socket to be created (with timeout)
-	if err := t.waitForSocket(10 * time.Second); err != nil {
-		t.Close()
+	if err := t.waitForSocket(10*time.Second, exited); err != nil {
+		cmd.Process.Kill()
+		os.RemoveAll(socketDir)
 		return fmt.Errorf("SSH tunnel failed to create socket: %w", err)
 	}
+	t.cmd = cmd
 
 	// Setup reverse proxy transport to use UNIX socket
 	transport := &http.Transport{
 		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 			var d net.Dialer
-			return d.DialContext(ctx, "unix", t.socketPath)
+			return d.DialContext(ctx, "unix", socketPath)
 		},
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: t.InsecureSkipVerifyTLS,
@@ -98,46 +115,100 @@ func (t *SSHTunnel) Open() error {
 	// Create reverse proxy
 	director := func(req *http.Request) {
 		req.URL.Scheme = remoteUrl.Scheme
-		req.URL.Host = t.ForwardsTo
-		req.Host = t.ForwardsTo
+		req.URL.Host = remoteUrl.Host
+		req.Host = remoteUrl.Host
 	}
 	t.proxy = &httputil.ReverseProxy{
 		Director:  director,
 		Transport: transport,
 	}
 
-	// Handle reconnection in background if enabled (default true)
+	return nil
+}
+
+// wait reaps cmd and, if it exited on its own, reconnects when enabled (default true).
+func (t *SSHTunnel) wait(cmd *exec.Cmd, exited chan struct{}) {
+	err := cmd.Wait()
+	close(exited)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cmd != cmd {
+		// killed by Close, or never finished opening
+		return
+	}
+	log.Printf("SSH tunnel to %s exited: %v", t.Host, err)
+	t.cmd = nil
+	t.proxy = nil
+	os.RemoveAll(path.Dir(t.socketPath))
+	if err == nil {
+		err = fmt.Errorf("ssh exited")
+	}
+	t.status.lost(err, t.unlockedShouldReconnect())
+
 	if t.unlockedShouldReconnect() {
-		context.AfterFunc(t.ctx, func() {
-			t.mu.Lock()
-			defer t.mu.Unlock()
-
-			t.cmd.Process.Kill()
-			log.Printf("SSH tunnel to %s exited", t.Host)
-
-			if t.unlockedShouldReconnect() {
-				// spawn coroutine to prevent recursive loop
-				go func() {
-					time.Sleep(1 * time.Second) // Brief pause before reconnect
-					log.Printf("Reconnecting SSH tunnel to %s...", t.Host)
-					if err := t.Open(); err != nil {
-						log.Printf("Failed to reconnect SSH tunnel to %s: %v", t.Host, err)
-					}
-				}()
+		// spawn coroutine to prevent recursive loop
+		go func() {
+			time.Sleep(1 * time.Second) // Brief pause before reconnect
+			log.Printf("Reconnecting SSH tunnel to %s...", t.Host)
+			if err := t.Open(); err != nil {
+				log.Printf("Failed to reconnect SSH tunnel to %s: %v", t.Host, err)
 			}
-		})
+		}()
 	}
+}
 
-	return nil
+// args builds the ssh arguments forwarding the socket to remoteAddr. Options from
+// ssh_options come before the defaults, ssh uses the first value it sees for a key.
+func (t *SSHTunnel) args(remoteAddr string) []string {
+	args := []string{"-N"}
+	if t.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(t.Port))
+	}
+	if t.User != "" {
+		args = append(args, "-l", t.User)
+	}
+	if t.IdentityFile != "" {
+		args = append(args, "-i", t.IdentityFile)
+	}
+	if t.ProxyJump != "" {
+		args = append(args, "-J", t.ProxyJump)
+	}
+	if t.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+t.KnownHostsFile)
+	}
+
+	keys := make([]string, 0, len(t.SSHOptions))
+	for key := range t.SSHOptions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "-o", key+"="+t.SSHOptions[key])
+	}
+
+	args = append(args,
+		"-o", "ServerAliveInterval=60",
+		"-o", "ServerAliveCountMax=3",
+		"-L", fmt.Sprintf("%s:%s", t.socketPath, remoteAddr),
+		// "--" so a host starting with "-" is not taken as an option
+		"--", t.Host,
+	)
+	return args
 }
 
-func (t *SSHTunnel) waitForSocket(timeout time.Duration) error {
+func (t *SSHTunnel) waitForSocket(timeout time.Duration, exited <-chan struct{}) error {
 	deadline := time.Now().Add(timeout)
 	for time.Now().Before(deadline) {
 		if _, err := os.Stat(t.socketPath); err == nil {
 			return nil
 		}
-		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-exited:
+			return fmt.Errorf("ssh exited")
+		case <-time.After(100 * time.Millisecond):
+		}
 	}
 	return fmt.Errorf("timeout waiting for socket %s", t.socketPath)
 }
@@ -149,16 +220,28 @@ func (t *SSHTunnel) Close() {
 	t.stopped = true
 	if t.cmd != nil {
 		t.cmd.Process.Kill()
-		t.cancel()
+		t.cmd = nil
+		t.proxy = nil
 	}
 	if t.socketPath != "" {
 		os.RemoveAll(path.Dir(t.socketPath))
+		t.socketPath = ""
 	}
+	t.status.closed()
+}
+
+func (t *SSHTunnel) Status() TunnelStatus {
+	return t.status.Status()
 }
 
 func (t *SSHTunnel) Forward(w http.ResponseWriter, r *http.Request) {
 	t.mu.Lock()
-	defer t.mu.Unlock()
+	proxy := t.proxy
+	t.mu.Unlock()
 
-	t.proxy.ServeHTTP(w, r)
+	if proxy == nil {
+		http.Error(w, "SSH tunnel is closed", http.StatusBadGateway)
+		return
+	}
+	proxy.ServeHTTP(w, r)
 }
@@ -0,0 +1,53 @@
+package althost
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSSHTunnelArgs(t *testing.T) {
+	tail := func(host string) []string {
+		return []string{
+			"-o", "ServerAliveInterval=60",
+			"-o", "ServerAliveCountMax=3",
+			"-L", "/tmp/tun.sock:localhost:8080",
+			"--", host,
+		}
+	}
+	tests := []struct {
+		name   string
+		tunnel *SSHTunnel
+		want   []string
+	}{
+		{"host only", &SSHTunnel{Host: "example.com"},
+			append([]string{"-N"}, tail("example.com")...)},
+		{"all options", &SSHTunnel{
+			Host:           "example.com",
+			Port:           2222,
+			User:           "deploy",
+			IdentityFile:   "/keys/id_ed25519",
+			ProxyJump:      "bastion",
+			KnownHostsFile: "/keys/known_hosts",
+			SSHOptions:     map[string]string{"StrictHostKeyChecking": "yes", "Compression": "yes"},
+		}, append([]string{
+			"-N",
+			"-p", "2222",
+			"-l", "deploy",
+			"-i", "/keys/id_ed25519",
+			"-J", "bastion",
+			"-o", "UserKnownHostsFile=/keys/known_hosts",
+			"-o", "Compression=yes",
+			"-o", "StrictHostKeyChecking=yes",
+		}, tail("example.com")...)},
+		{"host looking like an option", &SSHTunnel{Host: "-oProxyCommand=evil"},
+			append([]string{"-N"}, tail("-oProxyCommand=evil")...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.tunnel.socketPath = "/tmp/tun.sock"
+			if got := tt.tunnel.args("localhost:8080"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("args() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package althost
+
+import (
+	"sync"
+	"time"
+)
+
+// TunnelState is the connection state of a tunnel:
+// closed -> connecting -> connected -> reconnecting -> connected, or failed.
+type TunnelState string
+
+const (
+	TunnelClosed       TunnelState = "closed"
+	TunnelConnecting   TunnelState = "connecting"
+	TunnelConnected    TunnelState = "connected"
+	TunnelReconnecting TunnelState = "reconnecting" // connection lost, reconnecting
+	TunnelFailed       TunnelState = "failed"       // the last attempt failed, or the connection was lost without reconnect
+)
+
+type TunnelStatus struct {
+	State          TunnelState
+	LastError      string     // error of the last failed attempt or lost connection, kept after recovering
+	Reconnects     int        // times the connection was re-established after being lost
+	ConnectedSince *time.Time // set while connected
+}
+
+// statusTracker records a tunnel's status. It has its own mutex so Status does not wait
+// on a tunnel that is busy connecting.
+type statusTracker struct {
+	mu     sync.Mutex
+	status TunnelStatus
+}
+
+func (st *statusTracker) Status() TunnelStatus {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	status := st.status
+	if status.State == "" {
+		status.State = TunnelClosed
+	}
+	return status
+}
+
+func (st *statusTracker) connecting() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.status.State != TunnelReconnecting {
+		st.status.State = TunnelConnecting
+	}
+}
+
+func (st *statusTracker) connected() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.status.State == TunnelReconnecting {
+		st.status.Reconnects++
+	}
+	now := time.Now()
+	st.status.State = TunnelConnected
+	st.status.ConnectedSince = &now
+}
+
+func (st *statusTracker) failed(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.status.State = TunnelFailed
+	st.status.LastError = err.Error()
+	st.status.ConnectedSince = nil
+}
+
+// errored records a failed request without changing the state.
+func (st *statusTracker) errored(err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.status.LastError = err.Error()
+}
+
+// lost records a connection that dropped on its own.
+func (st *statusTracker) lost(err error, reconnect bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.status.State = TunnelFailed
+	if reconnect {
+		st.status.State = TunnelReconnecting
+	}
+	if err != nil {
+		st.status.LastError = err.Error()
+	}
+	st.status.ConnectedSince = nil
+}
+
+func (st *statusTracker) closed() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.status.State = TunnelClosed
+	st.status.ConnectedSince = nil
+}
@@ -0,0 +1,174 @@
+// Package certstore picks TLS certificates by SNI name and reloads them when their
+// files change.
+package certstore
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"serveroute/internal/watch"
+)
+
+type Pair struct {
+	CertFile string
+	KeyFile  string
+	Hosts    []string // names served with this pair, may start with "*.", defaults to the certificate's DNS names
+	Default  bool     // served when no name matches
+}
+
+type entry struct {
+	pair Pair
+	cert *tls.Certificate // last successfully loaded, kept if a reload fails
+}
+
+type Store struct {
+	mu       sync.RWMutex
+	entries  []*entry
+	byName   map[string]*tls.Certificate
+	fallback *tls.Certificate
+	rewatch  func() // restarts Watch with the current files
+}
+
+func New() *Store {
+	return &Store{byName: make(map[string]*tls.Certificate)}
+}
+
+// Set replaces the configured pairs and loads them. Pairs whose files are unchanged
+// keep their certificate if loading fails.
+func (s *Store) Set(pairs []Pair) error {
+	s.mu.Lock()
+	old := make(map[files]*tls.Certificate)
+	for _, e := range s.entries {
+		old[keyOf(e.pair)] = e.cert
+	}
+	s.entries = nil
+	for _, pair := range pairs {
+		s.entries = append(s.entries, &entry{pair: pair, cert: old[keyOf(pair)]})
+	}
+	rewatch := s.rewatch
+	s.mu.Unlock()
+
+	if rewatch != nil {
+		rewatch()
+	}
+	return s.Reload()
+}
+
+type files struct{ cert, key string }
+
+func keyOf(pair Pair) files {
+	return files{pair.CertFile, pair.KeyFile}
+}
+
+// Reload reads every pair from disk again and rebuilds the name index.
+func (s *Store) Reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, e := range s.entries {
+		cert, err := loadPair(e.pair)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		e.cert = cert
+	}
+
+	s.byName = make(map[string]*tls.Certificate)
+	s.fallback = nil
+	for _, e := range s.entries {
+		if e.cert == nil {
+			continue
+		}
+		hosts := e.pair.Hosts
+		if len(hosts) == 0 {
+			hosts = e.cert.Leaf.DNSNames
+		}
+		for _, host := range hosts {
+			host = strings.ToLower(host)
+			if _, ok := s.byName[host]; !ok {
+				s.byName[host] = e.cert
+			}
+		}
+		if e.pair.Default || s.fallback == nil {
+			s.fallback = e.cert
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func loadPair(pair Pair) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate %s: %w", pair.CertFile, err)
+	}
+	if cert.Leaf == nil {
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate %s: %w", pair.CertFile, err)
+		}
+	}
+	return &cert, nil
+}
+
+// Lookup returns the certificate for name, matching exact names before wildcards, or
+// nil if there is none.
+func (s *Store) Lookup(name string) *tls.Certificate {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if cert, ok := s.byName[name]; ok {
+		return cert
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if cert, ok := s.byName["*."+parent]; ok {
+			return cert
+		}
+	}
+	return nil
+}
+
+// Default returns the certificate served when no name matches, or nil if the store is
+// empty.
+func (s *Store) Default() *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fallback
+}
+
+func (s *Store) Empty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.entries) == 0
+}
+
+// Watch reloads the store whenever one of its files changes, until ctx is cancelled.
+func (s *Store) Watch(ctx context.Context, interval time.Duration) {
+	for ctx.Err() == nil {
+		watchCtx, cancel := context.WithCancel(ctx)
+		s.mu.Lock()
+		s.rewatch = cancel
+		var paths []string
+		for _, e := range s.entries {
+			paths = append(paths, e.pair.CertFile, e.pair.KeyFile)
+		}
+		s.mu.Unlock()
+
+		watch.Files(watchCtx, interval, paths, func() {
+			log.Printf("Certificate files changed, reloading")
+			if err := s.Reload(); err != nil {
+				log.Printf("Failed to reload certificates, keeping the previous ones: %v", err)
+			}
+		})
+		cancel()
+	}
+}
@@ -2,10 +2,13 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"serveroute/internal/althost"
 	"serveroute/internal/service"
+	"sort"
+	"strings"
 
 	"github.com/goccy/go-yaml"
 )
@@ -17,16 +20,47 @@ type Config struct {
 	} `yaml:"listen"`
 	SSLCertificate      string                      `yaml:"ssl_certificate"`
 	SSLCertificateKey   string                      `yaml:"ssl_certificate_key"`
+	Certificates        []Certificate               `yaml:"certificates"`        // picked by SNI name, ssl_certificate is the default
+	ACME                *ACME                       `yaml:"acme"`                // issue certificates automatically for names without one
+	TLS                 string                      `yaml:"tls"`                 // "internal" to sign certificates with a local CA
+	InternalCAStorage   string                      `yaml:"internal_ca_storage"` // for tls: internal, relative to workdir, defaults to "internal-ca"
 	Domain              string                      `yaml:"domain"`
 	WorkDir             string                      `yaml:"workdir"`
 	Allowlist           []string                    `yaml:"allowlist"`
 	Blocklist           []string                    `yaml:"blocklist"`
+	TrustedProxies      []string                    `yaml:"trusted_proxies"`  // IPs or CIDRs whose forwarding headers are believed
+	ForwardedHeader     string                      `yaml:"forwarded_header"` // the one header trusted_proxies write, defaults to x-forwarded-for
+	ProxyProtocol       bool                        `yaml:"proxy_protocol"`   // expect a PROXY protocol header from trusted_proxies
+	AccessLog           bool                        `yaml:"access_log"`       // log every request with the resolved client IP
+	RedirectHTTPS       bool                        `yaml:"redirect_https"`   // answer plain HTTP with a redirect to listen.https
+	HSTS                *service.HSTS               `yaml:"hsts"`             // Strict-Transport-Security sent on HTTPS responses
 	Services            map[string]*service.Service `yaml:"services"`
-	ServicesBySubdomain map[string]service.NamedService
+	ServicesBySubdomain map[string][]service.NamedService
+	StartOrder          []string                    `yaml:"-"` // service names, dependencies first
 	AltHosts            map[string]*althost.AltHost `yaml:"alt_hosts"`
 	OnEvent             map[string][]string         `yaml:"on_event"`
 }
 
+const TLSInternal = "internal"
+
+const (
+	ForwardedHeaderXForwardedFor = "x-forwarded-for"
+	ForwardedHeaderForwarded     = "forwarded"
+)
+
+type Certificate struct {
+	Certificate string   `yaml:"certificate"` // relative to workdir
+	Key         string   `yaml:"key"`         // relative to workdir
+	Hosts       []string `yaml:"hosts"`       // names to serve it for, may start with "*.", defaults to the certificate's names
+}
+
+type ACME struct {
+	DirectoryURL  string `yaml:"directory_url"`  // defaults to Let's Encrypt
+	Email         string `yaml:"email"`          // optional, for expiry notices from the CA
+	Storage       string `yaml:"storage"`        // directory for the account key and certificates, relative to workdir, defaults to "acme"
+	CACertificate string `yaml:"ca_certificate"` // optional PEM file to trust for directory_url, e.g. a local Pebble
+}
+
 func LoadConfig(path string) (*Config, error) {
 	if path == "" {
 		return nil, fmt.Errorf("config file is required")
@@ -43,6 +77,7 @@ func LoadConfig(path string) (*Config, error) {
 	if err != nil {
 		return nil, fmt.Errorf("opening config: %w", err)
 	}
+	defer file.Close()
 
 	var cfg Config
 	dec := yaml.NewDecoder(file, yaml.ReferenceDirs(configFileDir))
@@ -60,13 +95,213 @@ func LoadConfig(path string) (*Config, error) {
 		}
 	}
 
+	switch cfg.TLS {
+	case "":
+	case TLSInternal:
+		if cfg.ACME != nil {
+			return nil, fmt.Errorf("tls: internal and acme cannot be used together")
+		}
+		if cfg.InternalCAStorage == "" {
+			cfg.InternalCAStorage = "internal-ca"
+		}
+		if !filepath.IsAbs(cfg.InternalCAStorage) {
+			cfg.InternalCAStorage = filepath.Join(cfg.WorkDir, cfg.InternalCAStorage)
+		}
+	default:
+		return nil, fmt.Errorf("tls must be empty or \"internal\"")
+	}
+
+	for i := range cfg.Certificates {
+		cert := &cfg.Certificates[i]
+		if cert.Certificate == "" || cert.Key == "" {
+			return nil, fmt.Errorf("certificates: certificate and key must be set")
+		}
+		if !filepath.IsAbs(cert.Certificate) {
+			cert.Certificate = filepath.Join(cfg.WorkDir, cert.Certificate)
+		}
+		if !filepath.IsAbs(cert.Key) {
+			cert.Key = filepath.Join(cfg.WorkDir, cert.Key)
+		}
+	}
+
+	if cfg.ACME != nil {
+		if cfg.ACME.Storage == "" {
+			cfg.ACME.Storage = "acme"
+		}
+		if !filepath.IsAbs(cfg.ACME.Storage) {
+			cfg.ACME.Storage = filepath.Join(cfg.WorkDir, cfg.ACME.Storage)
+		}
+		if cfg.ACME.CACertificate != "" && !filepath.IsAbs(cfg.ACME.CACertificate) {
+			cfg.ACME.CACertificate = filepath.Join(cfg.WorkDir, cfg.ACME.CACertificate)
+		}
+	}
+
+	if cfg.HSTS != nil {
+		if err := cfg.HSTS.Validate(); err != nil {
+			return nil, fmt.Errorf("hsts: %w", err)
+		}
+	}
+	if cfg.RedirectHTTPS && cfg.Listen.HTTPS == "" {
+		return nil, fmt.Errorf("redirect_https requires listen.https")
+	}
+
+	for _, proxy := range cfg.TrustedProxies {
+		if !validIPOrCIDR(proxy) {
+			return nil, fmt.Errorf("trusted_proxies: invalid IP or CIDR %q", proxy)
+		}
+	}
+	switch cfg.ForwardedHeader {
+	case "":
+		cfg.ForwardedHeader = ForwardedHeaderXForwardedFor
+	case ForwardedHeaderXForwardedFor, ForwardedHeaderForwarded:
+	default:
+		return nil, fmt.Errorf("forwarded_header must be %q or %q", ForwardedHeaderXForwardedFor, ForwardedHeaderForwarded)
+	}
+
+	for name, ah := range cfg.AltHosts {
+		if ah == nil {
+			return nil, fmt.Errorf("alt host %s: exactly one of ssh, native_ssh, http or unix must be set", name)
+		}
+		if err := ah.Validate(); err != nil {
+			return nil, fmt.Errorf("alt host %s: %w", name, err)
+		}
+	}
+
 	for name, svc := range cfg.Services {
 		if svc.Type() == service.ServiceTypeUnknown {
 			return nil, fmt.Errorf("service %s: one of serve_files, forwards_to, or api must be set", name)
 		}
+		svc.PathPrefix = service.NormalizePathPrefix(svc.PathPrefix)
+		if err := service.ValidatePort(svc.Port); err != nil {
+			return nil, fmt.Errorf("service %s: %w", name, err)
+		}
+		if svc.Port == service.PortAuto && len(svc.Start) == 0 {
+			return nil, fmt.Errorf("service %s: port: auto requires a start command", name)
+		}
+		for _, target := range svc.ForwardsTo {
+			if target == "" {
+				return nil, fmt.Errorf("service %s: forwards_to entries must not be empty", name)
+			}
+			if svc.Port == "" && strings.Contains(target, "$<PORT>") {
+				return nil, fmt.Errorf("service %s: forwards_to uses $<PORT> but no port is set", name)
+			}
+			// the port is only known once allocated, any valid one will do to check the rest
+			if _, err := service.ParseUpstreamURL(strings.ReplaceAll(target, "$<PORT>", "1")); err != nil {
+				return nil, fmt.Errorf("service %s: forwards_to: %w", name, err)
+			}
+		}
+		if svc.LoadBalance != nil {
+			if err := svc.LoadBalance.Validate(); err != nil {
+				return nil, fmt.Errorf("service %s: load_balance: %w", name, err)
+			}
+		}
+		if svc.Transport != nil {
+			if err := svc.Transport.Validate(); err != nil {
+				return nil, fmt.Errorf("service %s: transport: %w", name, err)
+			}
+		}
+		if svc.RedirectHTTPS != nil && *svc.RedirectHTTPS && cfg.Listen.HTTPS == "" {
+			return nil, fmt.Errorf("service %s: redirect_https requires listen.https", name)
+		}
+		if svc.HSTS != nil {
+			if err := svc.HSTS.Validate(); err != nil {
+				return nil, fmt.Errorf("service %s: hsts: %w", name, err)
+			}
+		}
+		for _, list := range [][]string{svc.Allowlist, svc.Blocklist} {
+			for _, entry := range list {
+				if !validIPOrCIDR(entry) {
+					return nil, fmt.Errorf("service %s: invalid IP or CIDR %q", name, entry)
+				}
+			}
+		}
+		if svc.Auth != nil {
+			if err := svc.Auth.Validate(); err != nil {
+				return nil, fmt.Errorf("service %s: auth: %w", name, err)
+			}
+			if basic := svc.Auth.Basic; basic != nil {
+				if basic.HtpasswdFile != "" && !filepath.IsAbs(basic.HtpasswdFile) {
+					basic.HtpasswdFile = filepath.Join(cfg.WorkDir, basic.HtpasswdFile)
+				}
+				if err := basic.Load(); err != nil {
+					return nil, fmt.Errorf("service %s: auth: %w", name, err)
+				}
+			}
+			if fa := svc.Auth.ForwardAuth; fa != nil {
+				authSvc, ok := cfg.Services[fa.Service]
+				if !ok || fa.Service == name || authSvc.Type() != service.ServiceTypeProxy {
+					return nil, fmt.Errorf("service %s: auth: forward_auth service must be another forwards_to service", name)
+				}
+			}
+		}
+		if svc.WorkDir != "" && !filepath.IsAbs(svc.WorkDir) {
+			svc.WorkDir = filepath.Join(cfg.WorkDir, svc.WorkDir)
+		}
+		if svc.EnvFile != "" && !filepath.IsAbs(svc.EnvFile) {
+			svc.EnvFile = filepath.Join(cfg.WorkDir, svc.EnvFile)
+		}
+		if svc.LoadingPageFile != "" && !filepath.IsAbs(svc.LoadingPageFile) {
+			svc.LoadingPageFile = filepath.Join(cfg.WorkDir, svc.LoadingPageFile)
+		}
+		if svc.LogFile != "" && !filepath.IsAbs(svc.LogFile) {
+			svc.LogFile = filepath.Join(cfg.WorkDir, svc.LogFile)
+		}
+		switch svc.Restart {
+		case "", service.RestartNever, service.RestartOnFailure, service.RestartAlways:
+		default:
+			return nil, fmt.Errorf("service %s: restart must be one of never, on-failure or always", name)
+		}
+		if svc.Readiness != nil {
+			if err := svc.Readiness.Validate(); err != nil {
+				return nil, fmt.Errorf("service %s: readiness: %w", name, err)
+			}
+		}
 	}
 
-	cfg.ServicesBySubdomain = service.MakeServicesBySubdomain(cfg.Services)
+	cfg.StartOrder, err = service.TopoSort(cfg.Services)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.ServicesBySubdomain, err = service.MakeServicesBySubdomain(cfg.Services)
+	if err != nil {
+		return nil, err
+	}
 
 	return &cfg, nil
 }
+
+// Hostnames returns every host name serveroute answers for: the domain, each service
+// subdomain and each alt host.
+func (cfg *Config) Hostnames() []string {
+	seen := make(map[string]bool)
+	var hosts []string
+	add := func(host string) {
+		if host != "" && !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+
+	add(cfg.Domain)
+	if cfg.Domain != "" {
+		for _, svc := range cfg.Services {
+			if svc.Subdomain != "" {
+				add(svc.Subdomain + "." + cfg.Domain)
+			}
+		}
+	}
+	for host := range cfg.AltHosts {
+		add(host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func validIPOrCIDR(s string) bool {
+	if strings.Contains(s, "/") {
+		_, _, err := net.ParseCIDR(s)
+		return err == nil
+	}
+	return net.ParseIP(s) != nil
+}
@@ -0,0 +1,50 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadExampleConfig(t *testing.T) {
+	cfg, err := LoadConfig("../../example.yaml")
+	if err != nil {
+		t.Fatalf("loading example.yaml: %v", err)
+	}
+
+	svc, ok := cfg.Services["auto_port_server"]
+	if !ok {
+		t.Fatal("example.yaml has no auto_port_server")
+	}
+	// $<PORT> is substituted once a port is allocated, not at load time
+	if got := svc.ForwardsTo.First(); got != "http://127.0.0.1:$<PORT>" {
+		t.Errorf("forwards_to = %q, want the $<PORT> template", got)
+	}
+}
+
+func TestLoadConfigRejectsAltHostWithTwoBackends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`
+domain: localhost
+alt_hosts:
+  remote.test:
+    ssh:
+      host: example.com
+      forwards_to: "http://localhost:8080"
+    http:
+      forwards_to: "http://localhost:8080"
+services: {}
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadConfig(path)
+	if err == nil {
+		t.Fatal("LoadConfig accepted an alt host with both ssh and http")
+	}
+	if want := "alt host remote.test: exactly one of"; !strings.Contains(err.Error(), want) {
+		t.Errorf("error = %v, want it to contain %q", err, want)
+	}
+}
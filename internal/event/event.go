@@ -5,8 +5,11 @@ import (
 )
 
 type Event struct {
-	Type    string `json:"type"`    // either "start" or "stop"
-	Service string `json:"service"` // name of service
+	Type     string `json:"type"`                // "start", "stop", "exit", "crash", "reload", "error", "tunnel_open" or "tunnel_close"
+	Service  string `json:"service"`             // name of service, empty for server-wide events
+	AltHost  string `json:"alt_host,omitempty"`  // name of alt host for "tunnel_open" and "tunnel_close" events
+	Error    string `json:"error,omitempty"`     // error message for "error" events
+	ExitCode *int   `json:"exit_code,omitempty"` // exit code for "exit" and "crash" events
 }
 
 type EventBus struct {
@@ -0,0 +1,191 @@
+// Package proxyproto reads HAProxy PROXY protocol (v1 and v2) headers, so a listener
+// behind a TCP load balancer sees the original client address.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Listener wraps accepted connections so that RemoteAddr reports the address from the
+// PROXY header. Only peers for which Trusted returns true may send a header, and for
+// them it is required. Connections from other peers are passed through untouched.
+type Listener struct {
+	net.Listener
+	Trusted func(ip net.IP) bool
+	Timeout time.Duration // for reading the header, defaults to 5 seconds
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	return &Conn{Conn: conn, trusted: l.Trusted, timeout: timeout}, nil
+}
+
+// Conn reads the PROXY header lazily, on the first Read or RemoteAddr, so a slow
+// client does not hold up Accept.
+type Conn struct {
+	net.Conn
+	trusted func(ip net.IP) bool
+	timeout time.Duration
+
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *Conn) init() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		c.remote = c.Conn.RemoteAddr()
+
+		peer, ok := c.remote.(*net.TCPAddr)
+		if !ok || c.trusted == nil || !c.trusted(peer.IP) {
+			return
+		}
+
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		addr, err := readHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Printf("PROXY protocol from %s: %v", peer, err)
+			c.err = err
+			return
+		}
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the PROXY header, or the peer's address
+// if there was none.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readHeader reads a v1 or v2 header. It returns a nil address for headers that carry
+// no client address, such as v1 UNKNOWN or v2 LOCAL.
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	if bytes.Equal(peek, v2Signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(peek, []byte("PROXY ")) {
+		return readV1(r)
+	}
+	return nil, fmt.Errorf("missing header")
+}
+
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	// the longest v1 header is 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("v1 header too long or not terminated by CRLF")
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("reading v2 header: %w", err)
+	}
+	version, command := header[12]>>4, header[12]&0x0f
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	if version != 2 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("reading v2 addresses: %w", err)
+	}
+
+	switch command {
+	case 0x0: // LOCAL, e.g. health checks from the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", command)
+	}
+
+	switch family {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("short IPv4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("short IPv6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	default:
+		// UNSPEC or UNIX sockets carry no usable client IP
+		return nil, nil
+	}
+}
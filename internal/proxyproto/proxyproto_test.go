@@ -0,0 +1,140 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// v2Header builds a v2 header with the given version/command byte, family and payload.
+func v2Header(versionCommand, family byte, payload []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, versionCommand, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func v2Addresses(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	payload := append(append([]byte{}, src...), dst...)
+	payload = binary.BigEndian.AppendUint16(payload, srcPort)
+	return binary.BigEndian.AppendUint16(payload, dstPort)
+}
+
+func TestReadHeader(t *testing.T) {
+	ipv4 := v2Addresses(net.IPv4(203, 0, 113, 5).To4(), net.IPv4(10, 0, 0, 1).To4(), 4711, 443)
+	ipv6 := v2Addresses(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 4711, 443)
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    string // client address, empty for none
+		wantErr bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.5 10.0.0.1 4711 443\r\n"), "203.0.113.5:4711", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 4711 443\r\n"), "[2001:db8::1]:4711", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 bad address", []byte("PROXY TCP4 nonsense 10.0.0.1 4711 443\r\n"), "", true},
+		{"v1 bad port", []byte("PROXY TCP4 203.0.113.5 10.0.0.1 99999 443\r\n"), "", true},
+		{"v1 missing fields", []byte("PROXY TCP4 203.0.113.5\r\n"), "", true},
+		{"v1 no crlf", []byte("PROXY TCP4 203.0.113.5 10.0.0.1 4711 443\n"), "", true},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), "", true},
+		{"v2 tcp4", v2Header(0x21, 0x11, ipv4), "203.0.113.5:4711", false},
+		{"v2 tcp6", v2Header(0x21, 0x21, ipv6), "[2001:db8::1]:4711", false},
+		{"v2 with tlvs", v2Header(0x21, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0x00)), "203.0.113.5:4711", false},
+		{"v2 local", v2Header(0x20, 0x00, nil), "", false},
+		{"v2 unix", v2Header(0x21, 0x31, make([]byte, 216)), "", false},
+		{"v2 short ipv4", v2Header(0x21, 0x11, ipv4[:8]), "", true},
+		{"v2 short ipv6", v2Header(0x21, 0x21, ipv6[:20]), "", true},
+		{"v2 truncated", v2Header(0x21, 0x11, ipv4)[:20], "", true},
+		{"v2 bad version", v2Header(0x11, 0x11, ipv4), "", true},
+		{"v2 bad command", v2Header(0x22, 0x11, ipv4), "", true},
+		{"no header", []byte("GET / HTTP/1.1\r\nHost: example.test\r\n\r\n"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := tt.input
+			if !tt.wantErr {
+				input = append(input, "GET / HTTP/1.1\r\n"...)
+			}
+			r := bufio.NewReader(bytes.NewReader(input))
+			addr, err := readHeader(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readHeader error = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("readHeader = %q, want %q", got, tt.want)
+			}
+			// the request after the header is left for the caller
+			if rest, _ := r.ReadString('\n'); rest != "GET / HTTP/1.1\r\n" {
+				t.Errorf("read past the header, left %q", rest)
+			}
+		})
+	}
+}
+
+func TestListener(t *testing.T) {
+	tests := []struct {
+		name     string
+		trusted  bool
+		send     string
+		wantAddr string // empty for the peer's own address
+		wantData string
+	}{
+		{"trusted with header", true, "PROXY TCP4 203.0.113.5 10.0.0.1 4711 443\r\nhello", "203.0.113.5:4711", "hello"},
+		{"trusted without header", true, "hello, this is no header", "", ""},
+		{"untrusted ignores header", false, "PROXY TCP4 203.0.113.5 10.0.0.1 4711 443\r\nhello", "",
+			"PROXY TCP4 203.0.113.5 10.0.0.1 4711 443\r\nhello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := &Listener{Listener: inner, Trusted: func(net.IP) bool { return tt.trusted }}
+			defer l.Close()
+
+			client, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Write([]byte(tt.send))
+			client.Close()
+
+			conn, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			wantAddr := tt.wantAddr
+			if wantAddr == "" {
+				wantAddr = client.LocalAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != wantAddr {
+				t.Errorf("RemoteAddr = %s, want %s", got, wantAddr)
+			}
+			data, err := io.ReadAll(conn)
+			if tt.wantData == "" {
+				if err == nil {
+					t.Errorf("read %q, want an error for the missing header", data)
+				}
+				return
+			}
+			if err != nil || string(data) != tt.wantData {
+				t.Errorf("read %q, %v, want %q", data, err, tt.wantData)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"serveroute/internal/config"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMEManager returns a certificate manager for every host name in the config,
+// re-read on each lookup so reloads can add hosts. By configuring acme the operator
+// agrees to the CA's terms of service.
+func (s *Server) newACMEManager(cfg *config.ACME) (*autocert.Manager, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CACertificate != "" {
+		pem, err := os.ReadFile(cfg.CACertificate)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca_certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_certificate %s has no PEM certificates", cfg.CACertificate)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	client := &acme.Client{
+		DirectoryURL: cfg.DirectoryURL,
+		HTTPClient: &http.Client{Transport: &orderLocations{
+			base:       transport,
+			byFinalize: make(map[string]orderLocation),
+		}},
+	}
+
+	if err := os.MkdirAll(cfg.Storage, 0700); err != nil {
+		return nil, fmt.Errorf("creating acme storage: %w", err)
+	}
+
+	return &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(cfg.Storage),
+		Email:  cfg.Email,
+		Client: client,
+		HostPolicy: func(ctx context.Context, host string) error {
+			if !slices.Contains(s.config().Hostnames(), host) {
+				return fmt.Errorf("host %s is not configured", host)
+			}
+			return nil
+		},
+	}, nil
+}
+
+// issueCertificates makes sure every configured host has a certificate, so the first
+// visitor does not wait on the CA. autocert renews them from then on.
+func (s *Server) issueCertificates() {
+	if s.acmeManager == nil {
+		return
+	}
+	for _, host := range s.config().Hostnames() {
+		hello := &tls.ClientHelloInfo{
+			ServerName: host,
+			// look like a modern client, so the ECDSA certificate they will be served is
+			// the one issued here
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		}
+		if _, err := s.acmeManager.GetCertificate(hello); err != nil {
+			log.Printf("Failed to obtain certificate for %s: %v", host, err)
+			continue
+		}
+		log.Printf("Certificate for %s is ready", host)
+	}
+}
+
+// orderLocations lets acme.Client wait on orders that are finalized asynchronously. It
+// polls the URL in the finalize response's Location header, which RFC 8555 does not
+// require and some CAs, such as Pebble, leave out. The order URL is remembered from
+// the new-order response and filled in.
+type orderLocations struct {
+	base http.RoundTripper
+
+	mu         sync.Mutex
+	byFinalize map[string]orderLocation // by finalize URL
+}
+
+type orderLocation struct {
+	url     string
+	created time.Time
+}
+
+// orderLocationTTL bounds how long an order that is never finalized, e.g. because its
+// challenge failed, is remembered.
+const orderLocationTTL = time.Hour
+
+func (t *orderLocations) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost {
+		return resp, err
+	}
+
+	t.mu.Lock()
+	order, finalizing := t.byFinalize[req.URL.String()]
+	delete(t.byFinalize, req.URL.String())
+	t.mu.Unlock()
+	if finalizing {
+		if resp.Header.Get("Location") == "" {
+			resp.Header.Set("Location", order.url)
+		}
+		return resp, nil
+	}
+
+	location := resp.Header.Get("Location")
+	if location == "" || resp.StatusCode != http.StatusCreated {
+		return resp, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	var created struct {
+		Finalize string `json:"finalize"`
+	}
+	if json.Unmarshal(body, &created) == nil && created.Finalize != "" {
+		t.mu.Lock()
+		now := time.Now()
+		for finalize, order := range t.byFinalize {
+			if now.Sub(order.created) > orderLocationTTL {
+				delete(t.byFinalize, finalize)
+			}
+		}
+		t.byFinalize[created.Finalize] = orderLocation{url: location, created: now}
+		t.mu.Unlock()
+	}
+	return resp, nil
+}
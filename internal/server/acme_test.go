@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"serveroute/internal/config"
+)
+
+// stubACME is a minimal RFC 8555 CA. It skips JWS signature checks, validates http-01
+// challenges against challengeURL, and, like Pebble, sends no Location header with
+// finalize responses.
+type stubACME struct {
+	*httptest.Server
+	challengeURL string // base URL answering /.well-known/acme-challenge/
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	mu     sync.Mutex
+	nonce  int
+	orders map[string]*stubOrder
+	issued int
+}
+
+type stubOrder struct {
+	domain string
+	token  string
+	status string // pending, ready, valid
+	chain  []byte
+}
+
+func newStubACME(t *testing.T) *stubACME {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "stub acme ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+
+	ca := &stubACME{caKey: caKey, caCert: caCert, orders: make(map[string]*stubOrder)}
+	ca.Server = httptest.NewServer(http.HandlerFunc(ca.handle))
+	t.Cleanup(ca.Close)
+	return ca
+}
+
+func (ca *stubACME) handle(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	ca.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", ca.nonce))
+
+	var payload []byte
+	if r.Method == http.MethodPost {
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payload, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	id := parts[len(parts)-1]
+	order := ca.orders[id]
+
+	switch parts[0] {
+	case "dir":
+		writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   ca.URL + "/nonce",
+			"newAccount": ca.URL + "/account",
+			"newOrder":   ca.URL + "/new-order",
+			"revokeCert": ca.URL + "/revoke",
+			"keyChange":  ca.URL + "/key-change",
+		})
+	case "nonce":
+		w.WriteHeader(http.StatusOK)
+	case "account":
+		w.Header().Set("Location", ca.URL+"/account/1")
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "valid"})
+	case "new-order":
+		var req struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		json.Unmarshal(payload, &req)
+		id := fmt.Sprint(len(ca.orders) + 1)
+		ca.orders[id] = &stubOrder{domain: req.Identifiers[0].Value, token: "token-" + id, status: "pending"}
+		w.Header().Set("Location", ca.URL+"/order/"+id)
+		writeJSON(w, http.StatusCreated, ca.orderJSON(id))
+	case "order":
+		writeJSON(w, http.StatusOK, ca.orderJSON(id))
+	case "authz":
+		status := "pending"
+		if order.status != "pending" {
+			status = "valid"
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status":     status,
+			"identifier": map[string]string{"type": "dns", "value": order.domain},
+			"challenges": []map[string]string{{
+				"type":   "http-01",
+				"url":    ca.URL + "/challenge/" + id,
+				"token":  order.token,
+				"status": status,
+			}},
+		})
+	case "challenge":
+		// validate right away, the answer is token.<account key thumbprint>
+		req, _ := http.NewRequest(http.MethodGet, ca.challengeURL+"/.well-known/acme-challenge/"+order.token, nil)
+		req.Host = order.domain
+		resp, err := http.DefaultClient.Do(req)
+		status := "invalid"
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK && bytes.HasPrefix(body, []byte(order.token+".")) {
+				status = "valid"
+				order.status = "ready"
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"type":   "http-01",
+			"url":    ca.URL + "/challenge/" + id,
+			"token":  order.token,
+			"status": status,
+		})
+	case "finalize":
+		var req struct {
+			CSR string `json:"csr"`
+		}
+		json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || order.status != "ready" {
+			http.Error(w, "bad finalize", http.StatusForbidden)
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(ca.nonce) + 100),
+			Subject:      pkix.Name{CommonName: order.domain},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		leaf, err := x509.CreateCertificate(rand.Reader, template, ca.caCert, csr.PublicKey, ca.caKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		order.chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})...)
+		order.status = "valid"
+		ca.issued++
+		// issued asynchronously as far as the client can tell, with no Location to poll
+		resp := ca.orderJSON(id)
+		resp["status"] = "processing"
+		delete(resp, "certificate")
+		writeJSON(w, http.StatusOK, resp)
+	case "cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(order.chain)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ca *stubACME) orderJSON(id string) map[string]interface{} {
+	order := ca.orders[id]
+	resp := map[string]interface{}{
+		"status":         order.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": order.domain}},
+		"authorizations": []string{ca.URL + "/authz/" + id},
+		"finalize":       ca.URL + "/finalize/" + id,
+	}
+	if order.status == "valid" {
+		resp["certificate"] = ca.URL + "/cert/" + id
+	}
+	return resp
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestIssueCertificates(t *testing.T) {
+	ca := newStubACME(t)
+	cfg := &config.Config{
+		Domain: "example.test",
+		ACME: &config.ACME{
+			DirectoryURL: ca.URL + "/dir",
+			Storage:      t.TempDir(),
+		},
+	}
+	s := NewServer(cfg)
+	manager, err := s.newACMEManager(cfg.ACME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.acmeManager = manager
+
+	// stands in for the HTTP listener, which answers challenges before anything else
+	challenges := httptest.NewServer(manager.HTTPHandler(http.NotFoundHandler()))
+	defer challenges.Close()
+	ca.challengeURL = challenges.URL
+
+	s.issueCertificates()
+
+	if ca.issued != 1 {
+		t.Fatalf("CA issued %d certificates, want 1", ca.issued)
+	}
+	cert, err := s.getCertificate(&tls.ClientHelloInfo{
+		ServerName:       "example.test",
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+	if err != nil {
+		t.Fatalf("getCertificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaf.VerifyHostname("example.test"); err != nil {
+		t.Errorf("served certificate: %v", err)
+	}
+	if ca.issued != 1 {
+		t.Errorf("CA issued %d certificates after serving, want the cached one", ca.issued)
+	}
+
+	locations := manager.Client.HTTPClient.Transport.(*orderLocations)
+	if n := len(locations.byFinalize); n != 0 {
+		t.Errorf("%d finalized orders still remembered", n)
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestOrderLocationsForgetsUnfinalizedOrders(t *testing.T) {
+	created := 0
+	locations := &orderLocations{
+		base: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			created++
+			body := fmt.Sprintf(`{"finalize": "https://ca.test/finalize/%d"}`, created)
+			return &http.Response{
+				StatusCode: http.StatusCreated,
+				Header:     http.Header{"Location": {fmt.Sprintf("https://ca.test/order/%d", created)}},
+				Body:       io.NopCloser(strings.NewReader(body)),
+			}, nil
+		}),
+		byFinalize: make(map[string]orderLocation),
+	}
+	newOrder := func() {
+		req, _ := http.NewRequest(http.MethodPost, "https://ca.test/new-order", nil)
+		if _, err := locations.RoundTrip(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an order whose challenge failed is never finalized
+	newOrder()
+	stale := locations.byFinalize["https://ca.test/finalize/1"]
+	stale.created = time.Now().Add(-2 * orderLocationTTL)
+	locations.byFinalize["https://ca.test/finalize/1"] = stale
+
+	newOrder()
+	if _, ok := locations.byFinalize["https://ca.test/finalize/1"]; ok {
+		t.Error("stale order was not forgotten")
+	}
+	if _, ok := locations.byFinalize["https://ca.test/finalize/2"]; !ok {
+		t.Error("new order was not remembered")
+	}
+}
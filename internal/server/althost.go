@@ -0,0 +1,194 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"serveroute/internal/althost"
+	"serveroute/internal/event"
+)
+
+// altHostState tracks the requests in flight through an alt host's tunnel, closing the
+// tunnel once it has been idle for the alt host's timeout.
+type altHostState struct {
+	openMu   sync.Mutex // held across opening and closing the tunnel, locked before mu
+	mu       sync.Mutex // all methods should lock unless prefixed by "unlocked"
+	name     string
+	ah       *althost.AltHost
+	eventBus *event.EventBus
+	open     bool        // set between a successful Open and Close
+	active   int         // in-flight requests, see acquire
+	timer    *time.Timer // idle timeout, only armed while no requests are active
+}
+
+// getOrCreateAltHostState returns the state for the alt host name, which must be a key
+// of Config.AltHosts.
+func (s *Server) getOrCreateAltHostState(name string, ah *althost.AltHost) *altHostState {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	return s.unlockedGetOrCreateAltHostState(name, ah)
+}
+
+// altHostByName returns the state for the configured alt host name.
+func (s *Server) altHostByName(name string) (*altHostState, bool) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	ah, ok := s.Config.AltHosts[name]
+	if !ok || ah.GetTunnel() == nil {
+		return nil, false
+	}
+	return s.unlockedGetOrCreateAltHostState(name, ah), true
+}
+
+func (s *Server) unlockedGetOrCreateAltHostState(name string, ah *althost.AltHost) *altHostState {
+	if st, ok := s.altHosts[name]; ok {
+		return st
+	}
+	st := &altHostState{
+		name:     name,
+		ah:       ah,
+		eventBus: s.EventBus,
+	}
+	s.altHosts[name] = st
+	return st
+}
+
+// acquire opens the tunnel if it is closed and marks a request as in flight. Every
+// successful acquire must be paired with release.
+func (st *altHostState) acquire() (althost.Tunnel, error) {
+	tunnel := st.ah.GetTunnel()
+	if tunnel == nil {
+		return nil, fmt.Errorf("no tunnel settings found")
+	}
+
+	// counted before opening so the idle timeout cannot close the tunnel under us, and
+	// without mu held so status requests do not wait on the connection
+	st.mu.Lock()
+	st.active++
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+	st.mu.Unlock()
+
+	// Open is a no-op for a running tunnel, and restarts one that died without reconnecting.
+	// openMu keeps a concurrent close from tearing it down before it is marked open.
+	st.openMu.Lock()
+	defer st.openMu.Unlock()
+	if err := tunnel.Open(); err != nil {
+		st.release()
+		return nil, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.open {
+		st.open = true
+		log.Printf("Opened tunnel for %s", st.name)
+		st.eventBus.Publish(event.Event{
+			Type:    "tunnel_open",
+			AltHost: st.name,
+		})
+	}
+	return tunnel, nil
+}
+
+// release marks a request as finished. Once none are active, the tunnel is closed after
+// the alt host's timeout unless another request arrives first.
+func (st *altHostState) release() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.active--
+	if st.active > 0 || st.ah.Timeout <= 0 {
+		return
+	}
+
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(st.ah.Timeout)*time.Second, func() {
+		st.openMu.Lock()
+		defer st.openMu.Unlock()
+		st.mu.Lock()
+		defer st.mu.Unlock()
+
+		if st.timer != timer || st.active > 0 {
+			return
+		}
+		st.timer = nil
+		log.Printf("Tunnel for %s idle for %ds, closing", st.name, st.ah.Timeout)
+		st.unlockedClose()
+	})
+	st.timer = timer
+}
+
+// close closes the tunnel and cancels a pending idle timeout.
+func (st *altHostState) close() {
+	st.openMu.Lock()
+	defer st.openMu.Unlock()
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.timer != nil {
+		st.timer.Stop()
+		st.timer = nil
+	}
+	st.unlockedClose()
+}
+
+func (st *altHostState) unlockedClose() {
+	if !st.open {
+		return
+	}
+	if tunnel := st.ah.GetTunnel(); tunnel != nil {
+		tunnel.Close()
+	}
+	st.open = false
+	st.eventBus.Publish(event.Event{
+		Type:    "tunnel_close",
+		AltHost: st.name,
+	})
+}
+
+// openTunnel opens the tunnel without a request, starting the idle timeout right away.
+func (st *altHostState) openTunnel() error {
+	if _, err := st.acquire(); err != nil {
+		return err
+	}
+	st.release()
+	return nil
+}
+
+// status reports the tunnel's connection along with the requests in flight through it.
+func (st *altHostState) status() map[string]interface{} {
+	st.mu.Lock()
+	active := st.active
+	st.mu.Unlock()
+
+	return tunnelStatus(st.ah, active)
+}
+
+func tunnelStatus(ah *althost.AltHost, active int) map[string]interface{} {
+	status := ah.GetTunnel().Status()
+	entry := map[string]interface{}{
+		"type":            ah.Type(),
+		"state":           status.State,
+		"reconnects":      status.Reconnects,
+		"active_requests": active,
+	}
+	if status.LastError != "" {
+		entry["last_error"] = status.LastError
+	}
+	if status.ConnectedSince != nil {
+		entry["connected_since"] = status.ConnectedSince
+	}
+	if ah.Timeout > 0 {
+		entry["timeout"] = ah.Timeout
+	}
+	return entry
+}
@@ -18,6 +18,16 @@ func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
 		s.apiListServices(w)
 	case "events":
 		s.apiEvents(w, r)
+	case "logs":
+		s.apiLogs(w, r)
+	case "logs/follow":
+		s.apiLogsFollow(w, r)
+	case "ca.crt":
+		s.apiCACertificate(w)
+	case "tunnels":
+		s.apiListTunnels(w)
+	case "tunnels/open", "tunnels/close", "tunnels/status":
+		s.apiTunnel(w, r, strings.TrimPrefix(path, "tunnels/"))
 	default:
 		var reqBody struct {
 			Service string `json:"service"`
@@ -43,7 +53,7 @@ func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
 
 		switch path {
 		case "start":
-			if err := state.Start(); err != nil {
+			if err := s.startService(namedSvc); err != nil {
 				json.NewEncoder(w).Encode(map[string]interface{}{
 					"status": "error",
 					"error":  err.Error(),
@@ -59,9 +69,11 @@ func (s *Server) handleAPI(w http.ResponseWriter, r *http.Request) {
 				"status": "ok",
 			})
 		case "status":
-			running := state.IsRunning()
+			status := state.Status()
 			json.NewEncoder(w).Encode(map[string]interface{}{
-				"running": running,
+				"running":            status == "ready",
+				"status":             status,
+				"active_connections": state.ActiveConnections(),
 			})
 		default:
 			w.WriteHeader(http.StatusNotFound)
@@ -86,16 +98,108 @@ func (s *Server) apiListServices(w http.ResponseWriter) {
 
 		status := "stopped"
 		if state, ok := s.Services[name]; ok {
-			if state.IsRunning() {
+			status = state.Status()
+			if status == "ready" {
 				status = "started"
 			}
 		}
 
-		result[name] = map[string]interface{}{
+		entry := map[string]interface{}{
 			"status":    status,
 			"subdomain": svc.Subdomain,
 		}
+		if svc.PathPrefix != "/" {
+			entry["path_prefix"] = svc.PathPrefix
+		}
+		if state, ok := s.Services[name]; ok {
+			if state.Port() != 0 {
+				entry["port"] = state.Port()
+			}
+			if balancer := state.Balancer(); balancer != nil {
+				entry["upstreams"] = balancer.Stats()
+			}
+		}
+		result[name] = entry
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
+
+func (s *Server) apiListTunnels(w http.ResponseWriter) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	result := make(map[string]interface{})
+
+	for name, ah := range s.Config.AltHosts {
+		if ah.GetTunnel() == nil {
+			continue
+		}
+		if st, ok := s.altHosts[name]; ok {
+			result[name] = st.status()
+		} else {
+			result[name] = tunnelStatus(ah, 0)
+		}
 	}
 
 	json.NewEncoder(w).Encode(result)
 }
+
+func (s *Server) apiTunnel(w http.ResponseWriter, r *http.Request, action string) {
+	var reqBody struct {
+		AltHost string `json:"alt_host"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "error",
+			"error":  "invalid request body",
+		})
+		return
+	}
+
+	st, ok := s.altHostByName(reqBody.AltHost)
+	if !ok {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "error",
+			"error":  "unknown alt host",
+		})
+		return
+	}
+
+	switch action {
+	case "open":
+		if err := st.openTunnel(); err != nil {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status": "error",
+				"error":  err.Error(),
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "ok",
+		})
+	case "close":
+		st.close()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "ok",
+		})
+	case "status":
+		json.NewEncoder(w).Encode(st.status())
+	}
+}
+
+// apiCACertificate serves the root of tls: internal, for browsers and tools to trust.
+func (s *Server) apiCACertificate(w http.ResponseWriter) {
+	if s.localCA == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "error",
+			"error":  "tls is not internal",
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="serveroute-ca.crt"`)
+	w.Write(s.localCA.CertPEM())
+}
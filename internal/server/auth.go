@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"serveroute/internal/service"
+)
+
+const forwardAuthTimeout = 10 * time.Second
+
+// authorize enforces the service's auth block. It returns the request to dispatch,
+// which may carry headers copied from forward auth, or false if a response has already
+// been written.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, namedSvc service.NamedService, clientIP string) (*http.Request, bool) {
+	auth := namedSvc.Svc.Auth
+	if auth == nil {
+		return r, true
+	}
+	if auth.CheckCredentials(r) {
+		return r, true
+	}
+	if auth.ForwardAuth == nil {
+		auth.Challenge(w, namedSvc.Name)
+		return r, false
+	}
+
+	resp, err := s.forwardAuth(r, auth.ForwardAuth, clientIP)
+	if err != nil {
+		log.Printf("Forward auth for service %s failed: %v", namedSvc.Name, err)
+		http.Error(w, "Authentication service unavailable", http.StatusBadGateway)
+		return r, false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if len(auth.ForwardAuth.CopyHeaders) == 0 {
+			return r, true
+		}
+		r2 := r.Clone(r.Context())
+		for _, name := range auth.ForwardAuth.CopyHeaders {
+			r2.Header.Del(name)
+			for _, value := range resp.Header.Values(name) {
+				r2.Header.Add(name, value)
+			}
+		}
+		return r2, true
+	}
+
+	// hand the denial, e.g. a redirect to a login page, back to the client. The body was
+	// read, and possibly truncated, by forwardAuth, so its framing headers no longer apply
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	removeHopHeaders(w.Header())
+	w.Header().Del("Content-Length")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return r, false
+}
+
+// forwardAuth sends the request's headers to the auth service, along with
+// X-Forwarded-* headers describing the original request.
+func (s *Server) forwardAuth(r *http.Request, fa *service.ForwardAuth, clientIP string) (*http.Response, error) {
+	namedSvc, ok := s.serviceByName(fa.Service)
+	if !ok {
+		return nil, fmt.Errorf("unknown service %s", fa.Service)
+	}
+	// held until the response is read, so the auth service's idle timeout applies to it
+	// even when it is only reached through forward auth
+	state := s.getOrCreateState(namedSvc)
+	state.Acquire()
+	defer state.Release()
+	if err := s.startService(namedSvc); err != nil {
+		return nil, fmt.Errorf("starting %s: %w", fa.Service, err)
+	}
+	balancer := state.Balancer()
+	if balancer == nil {
+		return nil, fmt.Errorf("service %s has no upstreams", fa.Service)
+	}
+
+	upstream := balancer.Pick(r, clientIP)
+	target := *upstream.URL
+	path := fa.Path
+	if path == "" {
+		path = "/"
+	}
+	target.Path = strings.TrimSuffix(target.Path, "/") + path
+
+	ctx, cancel := context.WithTimeout(r.Context(), forwardAuthTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Del("Content-Length")
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", requestScheme(r))
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-For", clientIP)
+
+	balancer.Begin(upstream)
+	// RoundTrip rather than a client, redirects are meant for the user
+	resp, err := s.getOrCreateProxy(state).transport.RoundTrip(req)
+	if err != nil {
+		balancer.End(upstream, err)
+		return nil, err
+	}
+	balancer.End(upstream, nil)
+
+	// the body outlives ctx's cancel, read it now
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+	resp.Body = io.NopCloser(strings.NewReader(string(body)))
+	return resp, nil
+}
+
+// hopHeaders only apply to a single connection, see RFC 9110 section 7.6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes hop-by-hop headers from h, including those named in Connection.
+func removeHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"serveroute/internal/config"
+	"serveroute/internal/service"
+)
+
+func newAuthTestServer(t *testing.T, services map[string]*service.Service) *Server {
+	t.Helper()
+	cfg := &config.Config{Domain: "localhost", Services: services}
+	var err error
+	if cfg.StartOrder, err = service.TopoSort(services); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ServicesBySubdomain, err = service.MakeServicesBySubdomain(services); err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(cfg)
+}
+
+func TestForwardAuthIdleTimeout(t *testing.T) {
+	authUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer authUpstream.Close()
+
+	s := newAuthTestServer(t, map[string]*service.Service{
+		"auth": {Subdomain: "auth", ForwardsTo: service.Upstreams{authUpstream.URL}, Timeout: 1},
+	})
+	r := httptest.NewRequest(http.MethodGet, "http://app.localhost/", nil)
+	resp, err := s.forwardAuth(r, &service.ForwardAuth{Service: "auth"}, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	// only reached through forward auth, the service still stops once idle
+	state := s.getOrCreateState(service.NamedService{Name: "auth", Svc: s.Config.Services["auth"]})
+	if n := state.ActiveConnections(); n != 0 {
+		t.Errorf("%d requests still active", n)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for state.Phase() != service.PhaseStopped {
+		if time.Now().After(deadline) {
+			t.Fatalf("auth service is %s after its timeout, want stopped", state.Phase())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeniedRequestCreatesNoState(t *testing.T) {
+	s := newAuthTestServer(t, map[string]*service.Service{
+		"allowlisted": {Subdomain: "allowlisted", ForwardsTo: service.Upstreams{"http://127.0.0.1:1"}, Allowlist: []string{"10.0.0.0/8"}},
+		"private": {Subdomain: "private", ForwardsTo: service.Upstreams{"http://127.0.0.1:1"},
+			Auth: &service.Auth{BearerTokens: []string{"secret"}}},
+	})
+	for _, host := range []string{"allowlisted.localhost", "private.localhost"} {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		s.handleRequest(rec, r)
+		if rec.Code != http.StatusForbidden && rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got status %d, want a denial", host, rec.Code)
+		}
+	}
+	if n := len(s.Services); n != 0 {
+		t.Errorf("denied requests created %d service states", n)
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"serveroute/internal/config"
+)
+
+// remoteIP returns the address of the connection's peer, as reported by the PROXY
+// protocol if that is enabled.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	for _, trusted := range s.config().TrustedProxies {
+		if matchesIPOrCIDR(ip, trusted) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP resolves the client's address. The forwarded_header written by the trusted
+// proxies is walked right to left starting from the peer, and only while each hop is a
+// trusted proxy, so clients cannot spoof their address by sending the headers themselves.
+// The other header is ignored, since proxies usually pass it through untouched.
+func (s *Server) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if net.ParseIP(ip) == nil || !s.isTrustedProxy(net.ParseIP(ip)) {
+		return ip
+	}
+
+	var hops []string
+	if s.config().ForwardedHeader == config.ForwardedHeaderForwarded {
+		hops = forwardedFor(r.Header)
+	} else {
+		hops = xForwardedFor(r.Header)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(hops[i])
+		if hop == nil {
+			// garbage from a hop we cannot vouch for, stop at the last trusted one
+			return ip
+		}
+		ip = hop.String()
+		if !s.isTrustedProxy(hop) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// xForwardedFor returns the addresses in all X-Forwarded-For headers, leftmost first.
+func xForwardedFor(header http.Header) []string {
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, part := range strings.Split(value, ",") {
+			hops = append(hops, strings.TrimSpace(part))
+		}
+	}
+	return hops
+}
+
+// forwardedFor returns the for= addresses in all RFC 7239 Forwarded headers, leftmost
+// first. Obfuscated identifiers and "unknown" are kept as is
+// and fail to parse as IPs.
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	for _, value := range header.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if !ok || !strings.EqualFold(key, "for") {
+					continue
+				}
+				hops = append(hops, forwardedNode(val))
+			}
+		}
+	}
+	return hops
+}
+
+// forwardedNode strips the quotes, brackets and port from a Forwarded node such as
+// "[2001:db8::1]:4711" or 192.0.2.1:80.
+func forwardedNode(node string) string {
+	node = strings.Trim(node, `"`)
+	if strings.HasPrefix(node, "[") {
+		if end := strings.Index(node, "]"); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
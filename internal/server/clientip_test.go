@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"serveroute/internal/config"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name            string
+		forwardedHeader string
+		peer            string
+		header          http.Header
+		want            string
+	}{
+		{"untrusted peer", "", "198.51.100.1:1234",
+			http.Header{"X-Forwarded-For": {"10.0.0.7"}}, "198.51.100.1"},
+		{"no header", "", "127.0.0.1:1234", nil, "127.0.0.1"},
+		{"x-forwarded-for", "", "127.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"203.0.113.5"}}, "203.0.113.5"},
+		{"x-forwarded-for spoofed by the client", "", "127.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"10.0.0.7, 203.0.113.5"}}, "203.0.113.5"},
+		{"x-forwarded-for through trusted hops", "", "127.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"203.0.113.5, 10.1.2.3", "127.0.0.2"}}, "203.0.113.5"},
+		{"x-forwarded-for garbage", "", "127.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"203.0.113.5, nonsense"}}, "127.0.0.1"},
+		{"forwarded ignored by default", "", "127.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"203.0.113.5"}, "Forwarded": {"for=10.0.0.7"}}, "203.0.113.5"},
+		{"forwarded", config.ForwardedHeaderForwarded, "127.0.0.1:1234",
+			http.Header{"Forwarded": {`for=203.0.113.5;proto=https, for="[2001:db8::1]:4711"`}}, "2001:db8::1"},
+		{"forwarded spoofed by the client", config.ForwardedHeaderForwarded, "127.0.0.1:1234",
+			http.Header{"Forwarded": {"for=10.0.0.7", "for=203.0.113.5:80"}}, "203.0.113.5"},
+		{"x-forwarded-for ignored for forwarded", config.ForwardedHeaderForwarded, "127.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"10.0.0.7"}, "Forwarded": {"for=203.0.113.5"}}, "203.0.113.5"},
+		{"forwarded obfuscated", config.ForwardedHeaderForwarded, "127.0.0.1:1234",
+			http.Header{"Forwarded": {"for=_hidden"}}, "127.0.0.1"},
+		{"forwarded missing", config.ForwardedHeaderForwarded, "127.0.0.1:1234",
+			http.Header{"X-Forwarded-For": {"10.0.0.7"}}, "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(&config.Config{
+				TrustedProxies:  []string{"127.0.0.0/8", "10.1.0.0/16"},
+				ForwardedHeader: tt.forwardedHeader,
+			})
+			r := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+			r.RemoteAddr = tt.peer
+			r.Header = tt.header
+			if r.Header == nil {
+				r.Header = http.Header{}
+			}
+			if got := s.clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
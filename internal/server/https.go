@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net"
+	"net/http"
+
+	"serveroute/internal/service"
+)
+
+// isHTTPS reports whether the client connected over TLS, to serveroute or to a trusted
+// proxy in front of it.
+func (s *Server) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	ip := net.ParseIP(remoteIP(r))
+	return ip != nil && s.isTrustedProxy(ip) && r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// enforceHTTPS redirects plain HTTP requests to the HTTPS listener if redirect is set,
+// and adds the HSTS header to HTTPS responses. It returns false if it redirected.
+// ACME challenges are answered before requests reach here.
+func (s *Server) enforceHTTPS(w http.ResponseWriter, r *http.Request, redirect bool, hsts *service.HSTS) bool {
+	if s.isHTTPS(r) {
+		if hsts != nil {
+			w.Header().Set("Strict-Transport-Security", hsts.Header())
+		}
+		return true
+	}
+	if !redirect {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if _, port, err := net.SplitHostPort(s.config().Listen.HTTPS); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	target := "https://" + host + r.URL.RequestURI()
+	// 308 keeps the method and body, unlike 301
+	http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	return false
+}
+
+// httpsPolicy returns the redirect_https and hsts settings for svc, falling back to
+// the global ones.
+func (s *Server) httpsPolicy(svc *service.Service) (bool, *service.HSTS) {
+	cfg := s.config()
+	redirect, hsts := cfg.RedirectHTTPS, cfg.HSTS
+	if svc != nil {
+		if svc.RedirectHTTPS != nil {
+			redirect = *svc.RedirectHTTPS
+		}
+		if svc.HSTS != nil {
+			hsts = svc.HSTS
+		}
+	}
+	return redirect, hsts
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"serveroute/internal/service"
+)
+
+var defaultLoadingPage = template.Must(template.New("loading").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta http-equiv="refresh" content="1">
+    <title>Starting {{.Service}}...</title>
+    <style>
+        body { font-family: Arial, sans-serif; background-color: #f5f5f5; color: #333; text-align: center; padding-top: 20vh; }
+    </style>
+</head>
+<body>
+    <h1>Starting {{.Service}}...</h1>
+    <p>This page will reload automatically once the service is ready.</p>
+</body>
+</html>
+`))
+
+var startErrorPage = template.Must(template.New("start-error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Service}} failed to start</title>
+    <style>
+        body { font-family: Arial, sans-serif; background-color: #f5f5f5; color: #333; text-align: center; padding-top: 20vh; }
+        pre { display: inline-block; text-align: left; background-color: #f8d7da; color: #721c24; padding: 12px; border-radius: 4px; white-space: pre-wrap; }
+    </style>
+</head>
+<body>
+    <h1>{{.Service}} failed to start</h1>
+    <pre>{{.Error}}</pre>
+    <p>Reload the page to try again.</p>
+</body>
+</html>
+`))
+
+// wantsHTML reports whether r looks like a browser navigation rather than an API call.
+func wantsHTML(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// serveLoadingPage answers with an auto-refreshing page while the service starts in the
+// background. Custom pages are parsed as html/template with {{.Service}} available.
+func (s *Server) serveLoadingPage(w http.ResponseWriter, namedSvc service.NamedService) {
+	tmpl := defaultLoadingPage
+	if namedSvc.Svc.LoadingPageFile != "" {
+		data, err := os.ReadFile(namedSvc.Svc.LoadingPageFile)
+		if err == nil {
+			tmpl, err = template.New("loading").Parse(string(data))
+		}
+		if err != nil {
+			log.Printf("Failed to load loading page for %s: %v", namedSvc.Name, err)
+			tmpl = defaultLoadingPage
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	tmpl.Execute(w, map[string]interface{}{
+		"Service": namedSvc.Name,
+	})
+}
+
+// serveStartErrorPage answers with why the service failed to start. Unlike the loading
+// page it does not refresh, so a broken service is not restarted in a loop.
+func (s *Server) serveStartErrorPage(w http.ResponseWriter, namedSvc service.NamedService, err error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusBadGateway)
+	startErrorPage.Execute(w, map[string]interface{}{
+		"Service": namedSvc.Name,
+		"Error":   err.Error(),
+	})
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-contrib/sse"
+)
+
+func (s *Server) apiLogs(w http.ResponseWriter, r *http.Request) {
+	namedSvc, ok := s.serviceByName(r.URL.Query().Get("service"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "error",
+			"error":  "unknown service",
+		})
+		return
+	}
+	state := s.getOrCreateState(namedSvc)
+
+	tail, _ := strconv.Atoi(r.URL.Query().Get("tail"))
+	json.NewEncoder(w).Encode(state.Logs.Tail(tail))
+}
+
+func (s *Server) apiLogsFollow(w http.ResponseWriter, r *http.Request) {
+	namedSvc, ok := s.serviceByName(r.URL.Query().Get("service"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "error",
+			"error":  "unknown service",
+		})
+		return
+	}
+	state := s.getOrCreateState(namedSvc)
+
+	tail := 100
+	if n, err := strconv.Atoi(r.URL.Query().Get("tail")); err == nil {
+		tail = n
+	}
+
+	w.Header().Set("Content-Type", sse.ContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	id, lines, ch := state.Logs.Follow(tail)
+	defer state.Logs.Unfollow(id)
+
+	for _, line := range lines {
+		data, err := json.Marshal(line)
+		if err != nil {
+			return
+		}
+		if err := sse.Encode(w, sse.Event{Event: "message", Data: string(data)}); err != nil {
+			return
+		}
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	for {
+		select {
+		case line, ok := <-ch:
+			if !ok {
+				// log buffer closed, e.g. the service was removed on reload
+				return
+			}
+			data, err := json.Marshal(line)
+			if err != nil {
+				return
+			}
+			if err := sse.Encode(w, sse.Event{Event: "message", Data: string(data)}); err != nil {
+				return
+			}
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			// Client disconnected
+			return
+		}
+	}
+}
@@ -1,35 +1,119 @@
 package server
 
 import (
+	"context"
+	"errors"
+	"log"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"strings"
+
+	"serveroute/internal/service"
 )
 
-func (s *Server) proxyRequest(w http.ResponseWriter, r *http.Request, target string) {
-	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
-		target = "http://" + target
-	}
+// serviceProxy is the reverse proxy for one service. It is built once per ServiceState,
+// so connections to the upstreams are pooled across requests, and is replaced along
+// with the state when the service's definition changes.
+type serviceProxy struct {
+	proxy     *httputil.ReverseProxy
+	transport *http.Transport
+}
 
-	url, err := url.Parse(target)
-	if err != nil {
-		http.Error(w, "Invalid target URL", http.StatusInternalServerError)
-		return
-	}
+type proxyCtxKey struct{}
 
-	proxy := httputil.ReverseProxy{
-		Rewrite: func(pr *httputil.ProxyRequest) {
-			pr.SetURL(url)
-			pr.Out.Host = "localhost"
-			pr.Out.Header.Set("X-Real-IP", r.RemoteAddr)
+// proxyAttempt carries per-request state through the shared ReverseProxy.
+type proxyAttempt struct {
+	upstream *service.Upstream
+	clientIP string
+	vars     *strings.Replacer // header placeholders
+	err      error
+}
+
+func newServiceProxy(name string, svc *service.Service) *serviceProxy {
+	transport := service.NewTransport(svc.Transport)
+	headers := svc.Headers
+	preserveHost := svc.PreserveHost
 
-			if r.TLS != nil {
-				pr.Out.Header.Set("X-Forwarded-Proto", "https")
+	proxy := &httputil.ReverseProxy{
+		Transport: transport,
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			attempt := pr.In.Context().Value(proxyCtxKey{}).(*proxyAttempt)
+			pr.SetURL(attempt.upstream.URL)
+			if preserveHost {
+				pr.Out.Host = pr.In.Host
 			} else {
-				pr.Out.Header.Set("X-Forwarded-Proto", "http")
+				pr.Out.Host = "localhost"
+			}
+			pr.Out.Header.Set("X-Real-IP", attempt.clientIP)
+			pr.Out.Header.Set("X-Forwarded-Proto", requestScheme(pr.In))
+
+			headers.Request.Apply(pr.Out.Header, attempt.vars)
+			// Go sends the Host header from the request's Host field
+			if host := pr.Out.Header.Get("Host"); host != "" {
+				pr.Out.Host = host
+				pr.Out.Header.Del("Host")
 			}
 		},
+		ModifyResponse: func(resp *http.Response) error {
+			attempt := resp.Request.Context().Value(proxyCtxKey{}).(*proxyAttempt)
+			headers.Response.Apply(resp.Header, attempt.vars)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			attempt := r.Context().Value(proxyCtxKey{}).(*proxyAttempt)
+			// a client going away says nothing about the upstream's health
+			if !errors.Is(err, context.Canceled) {
+				attempt.err = err
+				log.Printf("Proxy error for service %s upstream %s: %v", name, attempt.upstream.URL, err)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		},
 	}
-	proxy.ServeHTTP(w, r)
+	return &serviceProxy{proxy: proxy, transport: transport}
+}
+
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func (s *Server) getOrCreateProxy(state *service.ServiceState) *serviceProxy {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	if p, ok := s.proxies[state]; ok {
+		return p
+	}
+	state.Mu.Lock()
+	p := newServiceProxy(state.Name, state.Service)
+	state.Mu.Unlock()
+	if s.Services[state.Name] != state {
+		// a request still holding a state replaced by Reload, which must not cache it
+		p.transport.DisableKeepAlives = true
+		return p
+	}
+	s.proxies[state] = p
+	return p
+}
+
+func (s *Server) proxyRequest(w http.ResponseWriter, r *http.Request, state *service.ServiceState, clientIP string) {
+	balancer := state.Balancer()
+	if balancer == nil {
+		http.Error(w, "Service has no upstreams", http.StatusBadGateway)
+		return
+	}
+
+	attempt := &proxyAttempt{
+		upstream: balancer.Pick(r, clientIP),
+		clientIP: clientIP,
+		vars:     service.HeaderVars(r.Host, clientIP, state.Name, requestScheme(r)),
+	}
+	balancer.Begin(attempt.upstream)
+	// deferred since ReverseProxy panics with http.ErrAbortHandler when the client goes away
+	defer func() { balancer.End(attempt.upstream, attempt.err) }()
+
+	r = r.WithContext(context.WithValue(r.Context(), proxyCtxKey{}, attempt))
+	s.getOrCreateProxy(state).proxy.ServeHTTP(w, r)
 }
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"serveroute/internal/config"
+	"serveroute/internal/service"
+)
+
+// TestProxyRequestClientGone checks that a request still ends on the balancer when the
+// client disconnects mid-response and ReverseProxy aborts the handler.
+func TestProxyRequestClientGone(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for r.Context().Err() == nil {
+			w.Write([]byte("chunk\n"))
+			w.(http.Flusher).Flush()
+			time.Sleep(time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	svc := &service.Service{ForwardsTo: service.Upstreams{upstream.URL}}
+	s := NewServer(&config.Config{Services: map[string]*service.Service{"web": svc}})
+	state := s.getOrCreateState(service.NamedService{Name: "web", Svc: svc})
+	if err := state.Start(); err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.proxyRequest(w, r, state, "127.0.0.1")
+	}))
+	defer front.Close()
+
+	resp, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if active := state.Balancer().Stats()[0].Active; active != 1 {
+		t.Fatalf("active = %d while streaming, want 1", active)
+	}
+	resp.Body.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for state.Balancer().Stats()[0].Active != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("active = %d after the client left, want 0", state.Balancer().Stats()[0].Active)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestProxyAfterReload checks that a request still holding the state replaced by a reload
+// does not leave its proxy behind for the new state.
+func TestProxyAfterReload(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Version")))
+	}))
+	defer upstream.Close()
+
+	newConfig := func(version string) *config.Config {
+		svc := &service.Service{ForwardsTo: service.Upstreams{upstream.URL}}
+		svc.Headers.Request.Set = map[string]string{"X-Version": version}
+		return &config.Config{Services: map[string]*service.Service{"web": svc}, StartOrder: []string{"web"}}
+	}
+	get := func(s *Server, state *service.ServiceState) string {
+		rec := httptest.NewRecorder()
+		s.proxyRequest(rec, httptest.NewRequest(http.MethodGet, "http://web.localhost/", nil), state, "127.0.0.1")
+		return rec.Body.String()
+	}
+
+	s := NewServer(newConfig("1"))
+	old := s.getOrCreateState(service.NamedService{Name: "web", Svc: s.Config.Services["web"]})
+	if err := old.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s.Reload(newConfig("2"))
+
+	// in flight during the reload, before any request reached the new state
+	if got := get(s, old); got != "1" {
+		t.Errorf("stale state sent X-Version %q, want 1", got)
+	}
+	state := s.getOrCreateState(service.NamedService{Name: "web", Svc: s.Config.Services["web"]})
+	if err := state.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if got := get(s, state); got != "2" {
+		t.Errorf("new state sent X-Version %q, want 2", got)
+	}
+}
+
+// BenchmarkProxy compares the cached per-service proxy with building a ReverseProxy on
+// the shared default transport for every request.
+func BenchmarkProxy(b *testing.B) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+
+	svc := &service.Service{ForwardsTo: service.Upstreams{upstream.URL}}
+	s := NewServer(&config.Config{Services: map[string]*service.Service{"bench": svc}})
+	state := s.getOrCreateState(service.NamedService{Name: "bench", Svc: svc})
+	if err := state.Start(); err != nil {
+		b.Fatal(err)
+	}
+	target, _ := url.Parse(upstream.URL)
+
+	serve := func(b *testing.B, handler func(w http.ResponseWriter, r *http.Request)) {
+		for i := 0; i < b.N; i++ {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, "http://bench.localhost/", nil))
+			if rec.Code != http.StatusOK {
+				b.Fatalf("got status %d", rec.Code)
+			}
+		}
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		serve(b, func(w http.ResponseWriter, r *http.Request) {
+			s.proxyRequest(w, r, state, "127.0.0.1")
+		})
+	})
+
+	b.Run("per-request", func(b *testing.B) {
+		serve(b, func(w http.ResponseWriter, r *http.Request) {
+			// as proxyRequest did before proxies were cached, on http.DefaultTransport
+			proxy := &httputil.ReverseProxy{
+				Rewrite: func(pr *httputil.ProxyRequest) {
+					pr.SetURL(target)
+				},
+			}
+			proxy.ServeHTTP(w, r)
+		})
+	})
+}
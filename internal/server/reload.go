@@ -0,0 +1,205 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"time"
+
+	"serveroute/internal/config"
+	"serveroute/internal/event"
+	"serveroute/internal/service"
+	"serveroute/internal/watch"
+
+	"github.com/goccy/go-yaml"
+)
+
+// sameDefinition reports whether two config values would serialize to the same YAML,
+// ignoring any runtime state kept in unexported fields.
+func sameDefinition(a, b interface{}) bool {
+	aData, err := yaml.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bData, err := yaml.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aData, bData)
+}
+
+// WatchConfig reloads the config whenever the file at path changes, until ctx is cancelled.
+func (s *Server) WatchConfig(ctx context.Context, path string) {
+	watch.Files(ctx, 2*time.Second, []string{path}, func() {
+		s.ReloadConfig(path)
+	})
+}
+
+// ReloadConfig parses the config at path and applies it. On failure the current config
+// stays live and an error event is published.
+func (s *Server) ReloadConfig(path string) {
+	log.Printf("Reloading config from %s", path)
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		log.Printf("Failed to reload config: %v", err)
+		s.EventBus.Publish(event.Event{
+			Type:  "error",
+			Error: err.Error(),
+		})
+		return
+	}
+	s.Reload(cfg)
+}
+
+// changedServices returns the services of old that are removed or redefined in cfg,
+// along with every service depending on one of them, directly or not.
+func changedServices(old, cfg *config.Config) map[string]bool {
+	changed := make(map[string]bool)
+	for name, oldSvc := range old.Services {
+		if newSvc, ok := cfg.Services[name]; !ok || !sameDefinition(oldSvc, newSvc) {
+			changed[name] = true
+		}
+	}
+	for name := range old.Services {
+		for _, dep := range service.Dependencies(old.Services, old.StartOrder, name) {
+			if changed[dep] {
+				changed[name] = true
+				break
+			}
+		}
+	}
+	return changed
+}
+
+// Reload swaps in cfg, stopping only the services and closing only the alt host tunnels
+// whose definitions changed. Stopped services start again on demand, or immediately if
+// they are marked autostart, but not before their old process has stopped.
+func (s *Server) Reload(cfg *config.Config) {
+	// SIGHUP and the config watcher may both reload, Mu alone is released too early
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.Mu.Lock()
+	old := s.Config
+
+	if old.Listen != cfg.Listen || old.WorkDir != cfg.WorkDir ||
+		old.ProxyProtocol != cfg.ProxyProtocol || !sameDefinition(old.ACME, cfg.ACME) ||
+		old.TLS != cfg.TLS || old.InternalCAStorage != cfg.InternalCAStorage {
+		log.Printf("Changes to listen, workdir, proxy_protocol, acme and tls require a restart to take effect")
+	}
+	// listen needs a restart, so the running HTTPS listener is the old one
+	reloadCerts := old.Listen.HTTPS != "" && (old.SSLCertificate != cfg.SSLCertificate || old.SSLCertificateKey != cfg.SSLCertificateKey ||
+		!sameDefinition(old.Certificates, cfg.Certificates))
+
+	changed := changedServices(old, cfg)
+
+	stale := make(map[string]*service.ServiceState)
+	var staleProxies []*serviceProxy
+	for name, state := range s.Services {
+		if newSvc, ok := cfg.Services[name]; ok && !changed[name] {
+			state.Mu.Lock()
+			state.Service = newSvc
+			state.Mu.Unlock()
+			continue
+		}
+		stale[name] = state
+		delete(s.Services, name)
+		s.stopping[name] = make(chan struct{})
+		if p, ok := s.proxies[state]; ok {
+			staleProxies = append(staleProxies, p)
+			delete(s.proxies, state)
+		}
+	}
+
+	var staleTunnels []string
+	var staleAltHosts []*altHostState
+	for name, oldAh := range old.AltHosts {
+		if newAh, ok := cfg.AltHosts[name]; ok && sameDefinition(oldAh, newAh) {
+			// keep the existing tunnel alive
+			cfg.AltHosts[name] = oldAh
+			continue
+		}
+		if tunnel := oldAh.GetTunnel(); tunnel != nil {
+			staleTunnels = append(staleTunnels, name)
+			if st, ok := s.altHosts[name]; ok {
+				// closed below, publishing tunnel_close if it was open
+				staleAltHosts = append(staleAltHosts, st)
+				delete(s.altHosts, name)
+			} else {
+				tunnel.Close()
+			}
+		}
+	}
+
+	var autostart []string
+	for _, name := range cfg.StartOrder {
+		svc := cfg.Services[name]
+		_, ok := old.Services[name]
+		if svc.Autostart && (!ok || changed[name]) {
+			autostart = append(autostart, name)
+		}
+	}
+
+	s.Config = cfg
+	s.Mu.Unlock()
+
+	// stop dependents before their dependencies
+	var stopOrder []*service.ServiceState
+	for i := len(old.StartOrder) - 1; i >= 0; i-- {
+		if state, ok := stale[old.StartOrder[i]]; ok {
+			stopOrder = append(stopOrder, state)
+			delete(stale, state.Name)
+		}
+	}
+	for _, state := range stale {
+		// created for a service removed by an earlier reload
+		stopOrder = append(stopOrder, state)
+	}
+	for _, state := range stopOrder {
+		log.Printf("Service %s changed or removed, or depends on one that did", state.Name)
+		state.Mu.Lock()
+		if state.Timer != nil {
+			state.Timer.Stop()
+		}
+		state.Mu.Unlock()
+		state.Stop()
+		state.Logs.Close()
+
+		s.Mu.Lock()
+		close(s.stopping[state.Name])
+		delete(s.stopping, state.Name)
+		s.Mu.Unlock()
+	}
+	for _, p := range staleProxies {
+		p.transport.CloseIdleConnections()
+	}
+	for _, st := range staleAltHosts {
+		st.close()
+	}
+	for _, name := range staleTunnels {
+		log.Printf("Closed tunnel for %s, it will reopen on the next request", name)
+	}
+
+	for _, name := range autostart {
+		namedSvc, ok := s.serviceByName(name)
+		if !ok {
+			continue
+		}
+		if err := s.startService(namedSvc); err != nil {
+			log.Printf("Failed to start service %s: %v", name, err)
+		}
+	}
+
+	if reloadCerts {
+		if err := s.certs.Set(certPairs(cfg)); err != nil {
+			log.Printf("Failed to load certificates: %v", err)
+		}
+	}
+
+	// certificates for hosts added by the reload
+	go s.issueCertificates()
+
+	s.EventBus.Publish(event.Event{
+		Type: "reload",
+	})
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"serveroute/internal/config"
+	"serveroute/internal/service"
+)
+
+func TestChangedServices(t *testing.T) {
+	newConfig := func(db string) *config.Config {
+		cfg := &config.Config{Services: map[string]*service.Service{
+			"db":     {Start: []string{db}},
+			"api":    {Start: []string{"api"}, DependsOn: []string{"db"}},
+			"web":    {Start: []string{"web"}, DependsOn: []string{"api"}},
+			"static": {ServeFiles: "public"},
+		}}
+		order, err := service.TopoSort(cfg.Services)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.StartOrder = order
+		return cfg
+	}
+
+	tests := []struct {
+		name string
+		cfg  *config.Config
+		want []string
+	}{
+		{"unchanged", newConfig("db"), nil},
+		{"dependency changed", newConfig("db --fast"), []string{"api", "db", "web"}},
+		{"dependency removed", func() *config.Config {
+			cfg := newConfig("db")
+			delete(cfg.Services, "db")
+			cfg.Services["api"] = &service.Service{Start: []string{"api"}}
+			return cfg
+		}(), []string{"api", "db", "web"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for name := range changedServices(newConfig("db"), tt.cfg) {
+				got = append(got, name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("changed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadWaitsForStaleStop(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	newConfig := func(env string) *config.Config {
+		cfg := &config.Config{Services: map[string]*service.Service{
+			"web": {
+				ForwardsTo: service.Upstreams{upstream.URL},
+				// slow to stop, like a server finishing its requests
+				Start:       []string{"sh", "-c", "trap 'sleep 0.5; exit 0' INT; while :; do sleep 0.05; done"},
+				KillTimeout: 5,
+				Env:         map[string]string{"VERSION": env},
+			},
+		}}
+		cfg.StartOrder = []string{"web"}
+		return cfg
+	}
+	s := NewServer(newConfig("1"))
+	oldCfg := s.Config
+	old := s.getOrCreateState(service.NamedService{Name: "web", Svc: oldCfg.Services["web"]})
+	if err := old.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := make(chan struct{})
+	go func() {
+		s.Reload(newConfig("2"))
+		close(reloaded)
+	}()
+	for s.config() == oldCfg {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a request routed with the old config while the old process is still stopping
+	state := s.getOrCreateState(service.NamedService{Name: "web", Svc: oldCfg.Services["web"]})
+	if phase := old.Phase(); phase != service.PhaseStopped {
+		t.Errorf("new state created while the old one is %s", phase)
+	}
+	if state == old {
+		t.Fatal("got the stale state")
+	}
+	if state.Service.Env["VERSION"] != "2" {
+		t.Errorf("new state has the old definition")
+	}
+	<-reloaded
+}
@@ -7,15 +7,21 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os/exec"
 	"strings"
 	"sync"
 	"time"
 
 	"serveroute/internal/althost"
+	"serveroute/internal/certstore"
 	"serveroute/internal/config"
 	"serveroute/internal/event"
+	"serveroute/internal/localca"
+	"serveroute/internal/proxyproto"
 	"serveroute/internal/service"
+
+	"golang.org/x/crypto/acme/autocert"
 )
 
 func isSubdomainOf(host, parentDomain string) bool {
@@ -39,12 +45,20 @@ func extractSubdomain(host, parentDomain string) (string, bool) {
 
 type Server struct {
 	Mu       sync.Mutex     // global mutex, all methods should lock unless prefixed by "unlocked"
-	Config   *config.Config // readonly
+	Config   *config.Config // replaced wholesale on reload, use config() outside of Mu
 	Services map[string]*service.ServiceState
 	EventBus *event.EventBus
 
+	reloadMu sync.Mutex                              // serializes Reload, which stops and starts services without Mu
+	stopping map[string]chan struct{}                // by service name, closed once Reload has stopped the stale state
+	proxies  map[*service.ServiceState]*serviceProxy // dropped along with stale states on reload
+	altHosts map[string]*altHostState                // by alt host name, dropped when the alt host changes on reload
+
 	httpServer  *http.Server
 	httpsServer *http.Server
+	acmeManager *autocert.Manager // set if acme is configured
+	certs       *certstore.Store
+	localCA     *localca.CA // set for tls: internal
 }
 
 func NewServer(cfg *config.Config) *Server {
@@ -52,14 +66,25 @@ func NewServer(cfg *config.Config) *Server {
 		Config:   cfg,
 		Services: make(map[string]*service.ServiceState),
 		EventBus: event.NewEventBus(),
+		stopping: make(map[string]chan struct{}),
+		proxies:  make(map[*service.ServiceState]*serviceProxy),
+		altHosts: make(map[string]*altHostState),
+		certs:    certstore.New(),
 	}
 }
 
+func (s *Server) config() *config.Config {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+	return s.Config
+}
+
 func (s *Server) StartAuto() error {
-	for name, svc := range s.Config.Services {
+	cfg := s.config()
+	for _, name := range cfg.StartOrder {
+		svc := cfg.Services[name]
 		if svc.Autostart {
-			state := s.getOrCreateState(service.NamedService{Name: name, Svc: svc})
-			if err := state.Start(); err != nil {
+			if err := s.startService(service.NamedService{Name: name, Svc: svc}); err != nil {
 				return fmt.Errorf("failed to start service %s: %w", name, err)
 			}
 		}
@@ -84,64 +109,127 @@ func (s *Server) Shutdown() {
 		s.httpsServer.Shutdown(shutdownCtx)
 	}
 
-	for _, state := range s.Services {
+	// stop dependents before their dependencies
+	for i := len(s.Config.StartOrder) - 1; i >= 0; i-- {
+		state, ok := s.Services[s.Config.StartOrder[i]]
+		if !ok {
+			continue
+		}
 		state.Mu.Lock()
 		state.EventBus = nil
 		state.Mu.Unlock()
 		state.Stop()
 	}
 
-	// Close all SSH tunnels
+	// Close all alt host tunnels
 	for host, ah := range s.Config.AltHosts {
 		tunnel := ah.GetTunnel()
 		if tunnel != nil {
 			log.Printf("Closing tunnel for %s", host)
-			tunnel.Close()
+			if st, ok := s.altHosts[host]; ok {
+				st.close()
+			} else {
+				tunnel.Close()
+			}
 		}
 	}
 }
 
 func (s *Server) ServeForever() {
 	http.HandleFunc("/", s.handleRequest)
+	cfg := s.config()
 
-	// Start event listener if on_event is configured
-	if len(s.Config.OnEvent) > 0 {
-		go s.listenEvents()
+	// Start event listener, on_event may be configured by a later reload
+	go s.listenEvents()
+
+	var handler http.Handler = http.DefaultServeMux
+	if cfg.ACME != nil {
+		manager, err := s.newACMEManager(cfg.ACME)
+		if err != nil {
+			log.Fatalf("ACME error: %v", err)
+		}
+		s.acmeManager = manager
+		// answer HTTP-01 challenges before anything else
+		handler = manager.HTTPHandler(handler)
 	}
 
-	if s.Config.Listen.HTTP != "" {
+	if cfg.Listen.HTTP != "" {
 		s.httpServer = &http.Server{
-			Addr: s.Config.Listen.HTTP,
+			Addr:    cfg.Listen.HTTP,
+			Handler: handler,
+		}
+		// bound before serving, so the listener is up once issueCertificates runs
+		log.Printf("Starting HTTP server on %s", cfg.Listen.HTTP)
+		l, err := s.listen(cfg.Listen.HTTP)
+		if err != nil {
+			log.Fatalf("HTTP server error: %v", err)
 		}
 		go func() {
-			log.Printf("Starting HTTP server on %s", s.Config.Listen.HTTP)
-			if err := s.httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			if err := s.httpServer.Serve(l); !errors.Is(err, http.ErrServerClosed) {
 				log.Fatalf("HTTP server error: %v", err)
 			}
 		}()
 	}
 
-	if s.Config.Listen.HTTPS != "" && s.Config.SSLCertificate != "" && s.Config.SSLCertificateKey != "" {
+	if cfg.TLS == config.TLSInternal {
+		ca, err := localca.Load(cfg.InternalCAStorage)
+		if err != nil {
+			log.Fatalf("HTTPS server error: %v", err)
+		}
+		s.localCA = ca
+		log.Printf("Signing certificates with the local CA in %s, trust ca.crt from there or the api's /ca.crt", cfg.InternalCAStorage)
+	}
+
+	if cfg.Listen.HTTPS != "" {
+		// certificates are only loaded for an HTTPS listener, HTTP-only configs may name them
+		if err := s.certs.Set(certPairs(cfg)); err != nil {
+			log.Fatalf("HTTPS server error: %v", err)
+		}
+		go s.certs.Watch(context.Background(), 2*time.Second)
+	}
+
+	if cfg.Listen.HTTPS != "" && (s.acmeManager != nil || s.localCA != nil || !s.certs.Empty()) {
 		s.httpsServer = &http.Server{
-			Addr: s.Config.Listen.HTTPS,
+			Addr:      cfg.Listen.HTTPS,
+			TLSConfig: s.tlsConfig(),
+		}
+		log.Printf("Starting HTTPS server on %s", cfg.Listen.HTTPS)
+		l, err := s.listen(cfg.Listen.HTTPS)
+		if err != nil {
+			log.Fatalf("HTTPS server error: %v", err)
 		}
 		go func() {
-			log.Printf("Starting HTTPS server on %s", s.Config.Listen.HTTPS)
-			if err := s.httpsServer.ListenAndServeTLS(s.Config.SSLCertificate, s.Config.SSLCertificateKey); !errors.Is(err, http.ErrServerClosed) {
+			if err := s.httpsServer.ServeTLS(l, "", ""); !errors.Is(err, http.ErrServerClosed) {
 				log.Fatalf("HTTPS server error: %v", err)
 			}
 		}()
 	}
 
+	// the listeners are bound above, so HTTP-01 and TLS-ALPN-01 challenges can be answered
+	go s.issueCertificates()
+
 	select {}
 }
 
+// listen opens a TCP listener on addr, reading PROXY protocol headers from trusted
+// proxies if proxy_protocol is set.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if !s.config().ProxyProtocol {
+		return l, nil
+	}
+	return &proxyproto.Listener{Listener: l, Trusted: s.isTrustedProxy}, nil
+}
+
 func (s *Server) listenEvents() {
 	id, ch := s.EventBus.Subscribe()
 	defer s.EventBus.Unsubscribe(id)
 
 	for event := range ch {
-		cmdTemplate, ok := s.Config.OnEvent[event.Type]
+		cmdTemplate, ok := s.config().OnEvent[event.Type]
 		if !ok {
 			continue
 		}
@@ -150,6 +238,7 @@ func (s *Server) listenEvents() {
 			// Build arguments with replacements
 			processed := strings.ReplaceAll(arg, "$<TYPE>", event.Type)
 			processed = strings.ReplaceAll(processed, "$<SERVICE>", event.Service)
+			processed = strings.ReplaceAll(processed, "$<ALT_HOST>", event.AltHost)
 			args = append(args, processed)
 		}
 		if len(args) == 0 {
@@ -170,19 +259,6 @@ func (s *Server) listenEvents() {
 	}
 }
 
-func getClientIP(r *http.Request) string {
-	xff := r.Header.Get("X-Forwarded-For")
-	if xff != "" {
-		parts := strings.Split(xff, ",")
-		return strings.TrimSpace(parts[0])
-	}
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return r.RemoteAddr
-	}
-	return host
-}
-
 func matchesIPOrCIDR(ip net.IP, pattern string) bool {
 	if strings.Contains(pattern, "/") {
 		_, ipNet, err := net.ParseCIDR(pattern)
@@ -199,17 +275,23 @@ func matchesIPOrCIDR(ip net.IP, pattern string) bool {
 }
 
 func (s *Server) isIPAllowed(ipStr string) bool {
+	cfg := s.config()
+	return ipAllowed(ipStr, cfg.Allowlist, cfg.Blocklist)
+}
+
+// ipAllowed reports whether ipStr passes blocklist, then allowlist if it is not empty.
+func ipAllowed(ipStr string, allowlist, blocklist []string) bool {
 	ip := net.ParseIP(ipStr)
 	if ip == nil {
 		return false
 	}
-	for _, blocked := range s.Config.Blocklist {
+	for _, blocked := range blocklist {
 		if matchesIPOrCIDR(ip, blocked) {
 			return false
 		}
 	}
-	if len(s.Config.Allowlist) > 0 {
-		for _, allowed := range s.Config.Allowlist {
+	if len(allowlist) > 0 {
+		for _, allowed := range allowlist {
 			if matchesIPOrCIDR(ip, allowed) {
 				return true
 			}
@@ -220,14 +302,20 @@ func (s *Server) isIPAllowed(ipStr string) bool {
 }
 
 func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
-	clientIP := getClientIP(r)
+	clientIP := s.clientIP(r)
+	if s.config().AccessLog {
+		aw := &accessLogWriter{ResponseWriter: w, status: http.StatusOK}
+		w = aw
+		defer aw.log(r, clientIP, time.Now())
+	}
+
 	if !s.isIPAllowed(clientIP) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
 	hostname := strings.Split(r.Host, ":")[0]
-	subdomain, isSelfDomain := extractSubdomain(hostname, s.Config.Domain)
+	subdomain, isSelfDomain := extractSubdomain(hostname, s.config().Domain)
 
 	if !isSelfDomain {
 		s.Mu.Lock()
@@ -237,34 +325,46 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 			}
 			if hostname == aHostname || isSubdomainOf(hostname, aHostname) {
 				s.Mu.Unlock()
-				s.handleAltHost(w, r, hostname, ah)
+				if redirect, hsts := s.httpsPolicy(nil); !s.enforceHTTPS(w, r, redirect, hsts) {
+					return
+				}
+				s.handleAltHost(w, r, aHostname, ah)
 				return
 			}
 		}
 		s.Mu.Unlock()
 	}
 
-	namedSvc, ok := s.serviceBySubdomain(subdomain)
+	namedSvc, ok := s.serviceByRoute(subdomain, r.URL.Path)
 	if !ok {
 		http.Error(w, "Service not found", http.StatusNotFound)
 		return
 	}
-	state := s.getOrCreateState(namedSvc)
 	svc := namedSvc.Svc
+	if redirect, hsts := s.httpsPolicy(svc); !s.enforceHTTPS(w, r, redirect, hsts) {
+		return
+	}
+	if !ipAllowed(clientIP, svc.Allowlist, svc.Blocklist) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	r, ok = s.authorize(w, r, namedSvc, clientIP)
+	if !ok {
+		return
+	}
+	// only once allowed, denied requests do not get a state and log buffer created
+	state := s.getOrCreateState(namedSvc)
+
+	if svc.StripPrefix && svc.PathPrefix != "/" {
+		r = stripPathPrefix(r, svc.PathPrefix)
+	}
 
-	state.Mu.Lock()
-	state.LastUsed = time.Now()
 	if svc.Type() == service.ServiceTypeProxy {
-		if state.Timer != nil {
-			state.Timer.Stop()
-		}
-		if svc.Timeout > 0 {
-			state.Timer = time.AfterFunc(time.Duration(svc.Timeout)*time.Second, func() {
-				state.Stop()
-			})
-		}
+		// held for the whole request, including upgraded connections such as websockets,
+		// so the idle timeout only counts down once nothing is in flight
+		state.Acquire()
+		defer state.Release()
 	}
-	state.Mu.Unlock()
 
 	switch svc.Type() {
 	case service.ServiceTypeAPI:
@@ -272,11 +372,37 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	case service.ServiceTypeFiles:
 		s.serveFiles(w, r, svc.ServeFiles)
 	case service.ServiceTypeProxy:
-		if err := state.Start(); err != nil {
+		if svc.LoadingPage && wantsHTML(r) {
+			switch state.Status() {
+			case "stopped":
+				// the start kicked off by an earlier visit failed, show why instead of
+				// refreshing into another attempt. The next visit tries again
+				if err := state.TakeStartError(); err != nil {
+					s.serveStartErrorPage(w, namedSvc, err)
+					return
+				}
+				go func() {
+					if err := s.startService(namedSvc); err != nil {
+						log.Printf("Failed to start service %s: %v", namedSvc.Name, err)
+					}
+				}()
+				s.serveLoadingPage(w, namedSvc)
+				return
+			case "starting":
+				s.serveLoadingPage(w, namedSvc)
+				return
+			}
+		}
+		if err := s.startService(namedSvc); err != nil {
+			if errors.Is(err, service.ErrStartQueueFull) || errors.Is(err, service.ErrStartQueueTimeout) {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
 			http.Error(w, fmt.Sprintf("Failed to start service: %v", err), http.StatusInternalServerError)
 			return
 		}
-		s.proxyRequest(w, r, svc.ForwardsTo)
+		s.proxyRequest(w, r, state, clientIP)
 	default:
 		panic("Service not configured") // configure happens on load
 	}
@@ -293,44 +419,91 @@ func (s *Server) serviceByName(name string) (service.NamedService, bool) {
 	}
 }
 
-func (s *Server) serviceBySubdomain(subdomain string) (service.NamedService, bool) {
+func (s *Server) serviceByRoute(subdomain, path string) (service.NamedService, bool) {
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
 
-	if namedSvc, ok := s.Config.ServicesBySubdomain[subdomain]; ok {
-		return namedSvc, true
-	} else {
-		return service.NamedService{}, false
+	return service.MatchRoute(s.Config.ServicesBySubdomain[subdomain], path)
+}
+
+// stripPathPrefix returns a shallow copy of r with prefix removed from its path.
+func stripPathPrefix(r *http.Request, prefix string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+
+	r2.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+	if r2.URL.Path == "" {
+		r2.URL.Path = "/"
+	}
+	if r.URL.RawPath != "" {
+		r2.URL.RawPath = strings.TrimPrefix(r.URL.RawPath, prefix)
+		if r2.URL.RawPath == "" {
+			r2.URL.RawPath = "/"
+		}
 	}
+	return r2
 }
 
 func (s *Server) getOrCreateState(namedSvc service.NamedService) *service.ServiceState {
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
 
-	if state, ok := s.Services[namedSvc.Name]; ok {
-		return state
+	for {
+		if state, ok := s.Services[namedSvc.Name]; ok {
+			return state
+		}
+		stopped, ok := s.stopping[namedSvc.Name]
+		if !ok {
+			break
+		}
+		// the replaced process may still hold the port, wait for Reload to stop it
+		s.Mu.Unlock()
+		<-stopped
+		s.Mu.Lock()
+	}
+	// namedSvc may have been looked up before a reload
+	if svc, ok := s.Config.Services[namedSvc.Name]; ok {
+		namedSvc.Svc = svc
 	}
 
 	state := &service.ServiceState{
 		Name:     namedSvc.Name,
 		Service:  namedSvc.Svc,
 		EventBus: s.EventBus,
+		Logs:     service.NewLogBuffer(namedSvc.Name, namedSvc.Svc),
 	}
 	s.Services[namedSvc.Name] = state
 	return state
 }
 
+// startService starts the service after starting, and waiting for, its dependencies.
+func (s *Server) startService(namedSvc service.NamedService) error {
+	cfg := s.config()
+	for _, dep := range service.Dependencies(cfg.Services, cfg.StartOrder, namedSvc.Name) {
+		depState := s.getOrCreateState(service.NamedService{Name: dep, Svc: cfg.Services[dep]})
+		if err := depState.Start(); err != nil {
+			err = fmt.Errorf("starting dependency %s: %w", dep, err)
+			s.getOrCreateState(namedSvc).RecordStartError(err)
+			return err
+		}
+	}
+	return s.getOrCreateState(namedSvc).Start()
+}
+
 func (s *Server) handleAltHost(w http.ResponseWriter, r *http.Request, ahName string, ah *althost.AltHost) {
-	tunnel := ah.GetTunnel()
-	if tunnel == nil {
+	if ah.GetTunnel() == nil {
 		http.Error(w, "Alt host configured but no tunnel settings found", http.StatusInternalServerError)
 		return
 	}
-	if err := tunnel.Open(); err != nil {
-		log.Printf("Failed to open SSH tunnel for %s: %v", ahName, err)
-		http.Error(w, "Failed to establish SSH tunnel", http.StatusBadGateway)
+	st := s.getOrCreateAltHostState(ahName, ah)
+	tunnel, err := st.acquire()
+	if err != nil {
+		log.Printf("Failed to open tunnel for %s: %v", ahName, err)
+		http.Error(w, "Failed to establish tunnel", http.StatusBadGateway)
 		return
 	}
+	defer st.release()
 	tunnel.Forward(w, r)
 }
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/acme"
+
+	"serveroute/internal/certstore"
+	"serveroute/internal/config"
+)
+
+// certPairs lists the certificates to load, with ssl_certificate as the default.
+func certPairs(cfg *config.Config) []certstore.Pair {
+	var pairs []certstore.Pair
+	if cfg.SSLCertificate != "" && cfg.SSLCertificateKey != "" {
+		pairs = append(pairs, certstore.Pair{
+			CertFile: cfg.SSLCertificate,
+			KeyFile:  cfg.SSLCertificateKey,
+			Default:  true,
+		})
+	}
+	for _, cert := range cfg.Certificates {
+		pairs = append(pairs, certstore.Pair{
+			CertFile: cert.Certificate,
+			KeyFile:  cert.Key,
+			Hosts:    cert.Hosts,
+		})
+	}
+	return pairs
+}
+
+func (s *Server) tlsConfig() *tls.Config {
+	var tlsConfig *tls.Config
+	if s.acmeManager != nil {
+		tlsConfig = s.acmeManager.TLSConfig()
+	} else {
+		tlsConfig = &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	}
+	tlsConfig.GetCertificate = s.getCertificate
+	return tlsConfig
+}
+
+// getCertificate serves a configured certificate matching the SNI name, then one from
+// the local CA or ACME, then the default certificate.
+func (s *Server) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if s.acmeManager != nil && slices.Contains(hello.SupportedProtos, acme.ALPNProto) {
+		return s.acmeManager.GetCertificate(hello)
+	}
+	if cert := s.certs.Lookup(hello.ServerName); cert != nil {
+		return cert, nil
+	}
+	if s.localCA != nil && slices.Contains(s.config().Hostnames(), hello.ServerName) {
+		return s.localCA.Leaf(hello.ServerName)
+	}
+	if s.acmeManager != nil {
+		cert, err := s.acmeManager.GetCertificate(hello)
+		if err == nil {
+			return cert, nil
+		}
+		if s.certs.Default() == nil {
+			return nil, err
+		}
+	}
+	if cert := s.certs.Default(); cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no certificate for %q", hello.ServerName)
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Auth guards a service. A request is let through if any of the configured methods
+// accepts it.
+type Auth struct {
+	Basic        *BasicAuth   `yaml:"basic"`
+	BearerTokens []string     `yaml:"bearer_tokens"` // accepted "Authorization: Bearer <token>" values
+	ForwardAuth  *ForwardAuth `yaml:"forward_auth"`
+}
+
+type BasicAuth struct {
+	Realm        string            `yaml:"realm"`         // defaults to the service name
+	Users        map[string]string `yaml:"users"`         // username: bcrypt hash
+	HtpasswdFile string            `yaml:"htpasswd_file"` // relative to the config's workdir, bcrypt entries only
+
+	users    map[string]string // Users merged with HtpasswdFile, see Load
+	mu       sync.Mutex
+	verified map[[32]byte]bool // credentials that already passed bcrypt, which is slow on purpose
+}
+
+// ForwardAuth asks another service whether to let a request through. A 2xx response
+// allows it, any other response is returned to the client as is, so the auth service
+// can redirect to a login page.
+type ForwardAuth struct {
+	Service     string   `yaml:"service"`      // name of a forwards_to service
+	Path        string   `yaml:"path"`         // requested on that service, defaults to "/"
+	CopyHeaders []string `yaml:"copy_headers"` // headers of an allowing response added to the request, e.g. X-User
+}
+
+func (a *Auth) Validate() error {
+	if a.Basic == nil && len(a.BearerTokens) == 0 && a.ForwardAuth == nil {
+		return fmt.Errorf("one of basic, bearer_tokens or forward_auth must be set")
+	}
+	for _, token := range a.BearerTokens {
+		if token == "" {
+			return fmt.Errorf("bearer_tokens must not be empty")
+		}
+	}
+	if a.Basic != nil && len(a.Basic.Users) == 0 && a.Basic.HtpasswdFile == "" {
+		return fmt.Errorf("basic: one of users or htpasswd_file must be set")
+	}
+	if a.ForwardAuth != nil && a.ForwardAuth.Service == "" {
+		return fmt.Errorf("forward_auth: service must be set")
+	}
+	return nil
+}
+
+// Load reads the htpasswd file, if any, and checks that every password is a bcrypt hash.
+func (b *BasicAuth) Load() error {
+	users := make(map[string]string, len(b.Users))
+	if b.HtpasswdFile != "" {
+		file, err := os.Open(b.HtpasswdFile)
+		if err != nil {
+			return fmt.Errorf("reading htpasswd_file: %w", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		lineNo := 0
+		for scanner.Scan() {
+			lineNo++
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			user, hash, ok := strings.Cut(line, ":")
+			if !ok {
+				return fmt.Errorf("%s:%d: expected user:hash", b.HtpasswdFile, lineNo)
+			}
+			users[user] = hash
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("reading htpasswd_file: %w", err)
+		}
+	}
+	for user, hash := range b.Users {
+		users[user] = hash
+	}
+
+	for user, hash := range users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("user %s: password must be a bcrypt hash (htpasswd -B)", user)
+		}
+	}
+	b.users = users
+	return nil
+}
+
+func (b *BasicAuth) check(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, ok := b.users[user]
+	if !ok {
+		return false
+	}
+
+	key := sha256.Sum256([]byte(user + "\x00" + pass + "\x00" + hash))
+	b.mu.Lock()
+	verified := b.verified[key]
+	b.mu.Unlock()
+	if verified {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return false
+	}
+	b.mu.Lock()
+	if b.verified == nil {
+		b.verified = make(map[[32]byte]bool)
+	}
+	b.verified[key] = true
+	b.mu.Unlock()
+	return true
+}
+
+func (a *Auth) checkBearer(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	for _, accepted := range a.BearerTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(accepted)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckCredentials reports whether r carries valid basic auth or bearer token
+// credentials. Forward auth is up to the caller.
+func (a *Auth) CheckCredentials(r *http.Request) bool {
+	if a.Basic != nil && a.Basic.check(r) {
+		return true
+	}
+	return len(a.BearerTokens) > 0 && a.checkBearer(r)
+}
+
+// Challenge writes a 401 response asking for the configured credentials.
+func (a *Auth) Challenge(w http.ResponseWriter, serviceName string) {
+	if a.Basic != nil {
+		realm := a.Basic.Realm
+		if realm == "" {
+			realm = serviceName
+		}
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+	} else {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
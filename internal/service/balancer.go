@@ -0,0 +1,258 @@
+package service
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Upstreams is one or more forwards_to targets. In YAML it may be a single string or a list.
+type Upstreams []string
+
+func (u *Upstreams) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var single string
+	if err := unmarshal(&single); err == nil {
+		if single == "" {
+			*u = nil
+		} else {
+			*u = Upstreams{single}
+		}
+		return nil
+	}
+	var list []string
+	if err := unmarshal(&list); err != nil {
+		return fmt.Errorf("forwards_to must be a string or a list of strings")
+	}
+	*u = list
+	return nil
+}
+
+// First returns the first target, or "" if there are none.
+func (u Upstreams) First() string {
+	if len(u) == 0 {
+		return ""
+	}
+	return u[0]
+}
+
+const (
+	StrategyRoundRobin = "round_robin"
+	StrategyLeastConn  = "least_conn"
+	StrategyHash       = "hash"
+)
+
+type LoadBalance struct {
+	Strategy      string `yaml:"strategy"`       // "round_robin" (default), "least_conn" or "hash"
+	HashKey       string `yaml:"hash_key"`       // for "hash": "client_ip" (default) or "cookie:<name>"
+	EjectDuration int    `yaml:"eject_duration"` // in seconds, skip an upstream this long after a connection error, defaults to 10
+}
+
+func (lb *LoadBalance) Validate() error {
+	switch lb.Strategy {
+	case "", StrategyRoundRobin, StrategyLeastConn, StrategyHash:
+	default:
+		return fmt.Errorf("strategy must be one of round_robin, least_conn or hash")
+	}
+	if lb.HashKey != "" && lb.HashKey != "client_ip" && !strings.HasPrefix(lb.HashKey, "cookie:") {
+		return fmt.Errorf("hash_key must be client_ip or cookie:<name>")
+	}
+	if lb.EjectDuration < 0 {
+		return fmt.Errorf("eject_duration must not be negative")
+	}
+	return nil
+}
+
+// ParseUpstreamURL parses a forwards_to target, defaulting to http:// if no scheme is given.
+func ParseUpstreamURL(target string) (*url.URL, error) {
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		target = "http://" + target
+	}
+	return url.Parse(target)
+}
+
+type Upstream struct {
+	URL *url.URL
+
+	active       atomic.Int64
+	requests     atomic.Int64
+	failures     atomic.Int64
+	ejectedUntil atomic.Int64 // unix nanoseconds
+}
+
+type UpstreamStats struct {
+	URL      string `json:"url"`
+	Healthy  bool   `json:"healthy"`
+	Active   int64  `json:"active"`
+	Requests int64  `json:"requests"`
+	Failures int64  `json:"failures"`
+}
+
+func (u *Upstream) healthy(now time.Time) bool {
+	return now.UnixNano() >= u.ejectedUntil.Load()
+}
+
+// Balancer picks an upstream for each request and passively ejects upstreams that fail.
+type Balancer struct {
+	upstreams []*Upstream
+	strategy  string
+	hashKey   string
+	eject     time.Duration
+	next      atomic.Uint64
+	ring      []ringEntry // for the hash strategy, sorted by hash
+}
+
+type ringEntry struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+const ringReplicas = 100
+
+func NewBalancer(targets []string, lb *LoadBalance) (*Balancer, error) {
+	if lb == nil {
+		lb = &LoadBalance{}
+	}
+	b := &Balancer{
+		strategy: lb.Strategy,
+		hashKey:  lb.HashKey,
+		eject:    10 * time.Second,
+	}
+	if lb.EjectDuration > 0 {
+		b.eject = time.Duration(lb.EjectDuration) * time.Second
+	}
+
+	for _, target := range targets {
+		u, err := ParseUpstreamURL(target)
+		if err != nil {
+			return nil, fmt.Errorf("parsing upstream %s: %w", target, err)
+		}
+		b.upstreams = append(b.upstreams, &Upstream{URL: u})
+	}
+	if len(b.upstreams) == 0 {
+		return nil, fmt.Errorf("no upstreams")
+	}
+
+	if b.strategy == StrategyHash {
+		for _, u := range b.upstreams {
+			for i := 0; i < ringReplicas; i++ {
+				h := crc32.ChecksumIEEE([]byte(u.URL.String() + "#" + strconv.Itoa(i)))
+				b.ring = append(b.ring, ringEntry{hash: h, upstream: u})
+			}
+		}
+		sort.Slice(b.ring, func(i, j int) bool { return b.ring[i].hash < b.ring[j].hash })
+	}
+	return b, nil
+}
+
+// Pick chooses an upstream for r. Ejected upstreams are skipped unless all are ejected.
+func (b *Balancer) Pick(r *http.Request, clientIP string) *Upstream {
+	now := time.Now()
+	if len(b.upstreams) == 1 {
+		return b.upstreams[0]
+	}
+
+	switch b.strategy {
+	case StrategyLeastConn:
+		var best *Upstream
+		for _, u := range b.upstreams {
+			if !u.healthy(now) {
+				continue
+			}
+			if best == nil || u.active.Load() < best.active.Load() {
+				best = u
+			}
+		}
+		if best != nil {
+			return best
+		}
+	case StrategyHash:
+		h := crc32.ChecksumIEEE([]byte(b.hashValue(r, clientIP)))
+		start := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= h })
+		for i := 0; i < len(b.ring); i++ {
+			entry := b.ring[(start+i)%len(b.ring)]
+			if entry.upstream.healthy(now) {
+				return entry.upstream
+			}
+		}
+	default:
+		for i := 0; i < len(b.upstreams); i++ {
+			u := b.upstreams[b.next.Add(1)%uint64(len(b.upstreams))]
+			if u.healthy(now) {
+				return u
+			}
+		}
+	}
+
+	// everything is ejected, fall back to plain round robin
+	return b.upstreams[b.next.Add(1)%uint64(len(b.upstreams))]
+}
+
+func (b *Balancer) hashValue(r *http.Request, clientIP string) string {
+	if name, ok := strings.CutPrefix(b.hashKey, "cookie:"); ok {
+		if cookie, err := r.Cookie(name); err == nil {
+			return cookie.Value
+		}
+	}
+	return clientIP
+}
+
+// Begin records the start of a request to u. Call End with the outcome when it finishes.
+func (b *Balancer) Begin(u *Upstream) {
+	u.active.Add(1)
+	u.requests.Add(1)
+}
+
+// End records the end of a request to u. A non-nil err ejects u for a while.
+func (b *Balancer) End(u *Upstream, err error) {
+	u.active.Add(-1)
+	if err != nil {
+		u.failures.Add(1)
+		if len(b.upstreams) > 1 {
+			u.ejectedUntil.Store(time.Now().Add(b.eject).UnixNano())
+		}
+	}
+}
+
+func (b *Balancer) Stats() []UpstreamStats {
+	now := time.Now()
+	stats := make([]UpstreamStats, 0, len(b.upstreams))
+	for _, u := range b.upstreams {
+		stats = append(stats, UpstreamStats{
+			URL:      u.URL.String(),
+			Healthy:  u.healthy(now),
+			Active:   u.active.Load(),
+			Requests: u.requests.Load(),
+			Failures: u.failures.Load(),
+		})
+	}
+	return stats
+}
+
+// Balancer returns the balancer over the service's upstreams, or nil if the service has
+// not been started yet. It does not take Mu, which is held while the service stops.
+func (state *ServiceState) Balancer() *Balancer {
+	return state.balancer.Load()
+}
+
+// unlockedBuildBalancer (re)builds the balancer for the currently assigned port, keeping
+// the existing one, and its stats, if the targets are unchanged.
+func (state *ServiceState) unlockedBuildBalancer() error {
+	targets := expandPortAll(state.Service.ForwardsTo, state.Port())
+	if state.balancer.Load() != nil && slices.Equal(state.balancerTargets, targets) {
+		return nil
+	}
+	balancer, err := NewBalancer(targets, state.Service.LoadBalance)
+	if err != nil {
+		return err
+	}
+	state.balancer.Store(balancer)
+	state.balancerTargets = targets
+	return nil
+}
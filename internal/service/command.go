@@ -0,0 +1,52 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// unlockedCommand builds a command for the service's start or stop arguments, applying
+// its port, env, env_file, workdir, user and group settings and capturing its output in Logs.
+func (state *ServiceState) unlockedCommand(args []string) (*exec.Cmd, error) {
+	svc := state.Service
+	port := state.Port()
+
+	args = expandPortAll(args, port)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = svc.WorkDir
+
+	// later entries take precedence over earlier ones
+	env := os.Environ()
+	if svc.EnvFile != "" {
+		fileEnv, err := readEnvFile(svc.EnvFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading env_file: %w", err)
+		}
+		env = append(env, fileEnv...)
+	}
+	for key, value := range svc.Env {
+		env = append(env, key+"="+value)
+	}
+	if port != 0 {
+		env = append(env, "PORT="+strconv.Itoa(port))
+	}
+	cmd.Env = env
+
+	if state.Logs != nil {
+		cmd.Stdout = state.Logs.Writer("stdout", os.Stdout)
+		cmd.Stderr = state.Logs.Writer("stderr", os.Stderr)
+		// don't let grandchildren holding the output pipes open block Wait forever
+		cmd.WaitDelay = 1 * time.Second
+	} else {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+
+	if err := setCredential(cmd, svc.User, svc.Group); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package service
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+func setCredential(cmd *exec.Cmd, userName, groupName string) error {
+	if userName == "" && groupName == "" {
+		return nil
+	}
+	return fmt.Errorf("user and group are not supported on this platform")
+}
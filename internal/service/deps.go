@@ -0,0 +1,86 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TopoSort orders service names so that every service comes after its depends_on.
+// Services without ordering constraints are sorted by name. It fails on unknown
+// dependencies and cycles.
+func TopoSort(services map[string]*Service) ([]string, error) {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make(map[string]int)
+	order := make([]string, 0, len(services))
+	var path []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle: %s -> %s", strings.Join(path, " -> "), name)
+		}
+		marks[name] = visiting
+		path = append(path, name)
+		for _, dep := range services[name].DependsOn {
+			if _, ok := services[dep]; !ok {
+				return fmt.Errorf("service %s: unknown dependency %s", name, dep)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[name] = visited
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// Dependencies returns the transitive dependencies of name in start order, not
+// including name itself. order must come from TopoSort.
+func Dependencies(services map[string]*Service, order []string, name string) []string {
+	needed := make(map[string]bool)
+	var mark func(name string)
+	mark = func(name string) {
+		svc, ok := services[name]
+		if !ok {
+			return
+		}
+		for _, dep := range svc.DependsOn {
+			if !needed[dep] {
+				needed[dep] = true
+				mark(dep)
+			}
+		}
+	}
+	mark(name)
+
+	deps := make([]string, 0, len(needed))
+	for _, n := range order {
+		if needed[n] {
+			deps = append(deps, n)
+		}
+	}
+	return deps
+}
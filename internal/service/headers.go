@@ -0,0 +1,41 @@
+package service
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HeaderRules are applied in order: remove, then set, then add. Values may contain
+// $<HOST>, $<CLIENT_IP>, $<SERVICE> and $<SCHEME>.
+type HeaderRules struct {
+	Set    map[string]string `yaml:"set"`    // replaces any existing values
+	Add    map[string]string `yaml:"add"`    // appended to any existing values
+	Remove []string          `yaml:"remove"` // header names to drop
+}
+
+type Headers struct {
+	Request  HeaderRules `yaml:"request"`  // sent to forwards_to
+	Response HeaderRules `yaml:"response"` // sent back to the client
+}
+
+// HeaderVars returns the replacer for header placeholders.
+func HeaderVars(host, clientIP, service, scheme string) *strings.Replacer {
+	return strings.NewReplacer(
+		"$<HOST>", host,
+		"$<CLIENT_IP>", clientIP,
+		"$<SERVICE>", service,
+		"$<SCHEME>", scheme,
+	)
+}
+
+func (rules *HeaderRules) Apply(header http.Header, vars *strings.Replacer) {
+	for _, name := range rules.Remove {
+		header.Del(name)
+	}
+	for name, value := range rules.Set {
+		header.Set(name, vars.Replace(value))
+	}
+	for name, value := range rules.Add {
+		header.Add(name, vars.Replace(value))
+	}
+}
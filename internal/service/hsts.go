@@ -0,0 +1,34 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+)
+
+type HSTS struct {
+	MaxAge            int  `yaml:"max_age"` // in seconds, 0 tells browsers to forget the policy
+	IncludeSubdomains bool `yaml:"include_subdomains"`
+	Preload           bool `yaml:"preload"`
+}
+
+func (h *HSTS) Validate() error {
+	if h.MaxAge < 0 {
+		return fmt.Errorf("max_age must not be negative")
+	}
+	if h.Preload && (!h.IncludeSubdomains || h.MaxAge < 31536000) {
+		return fmt.Errorf("preload requires include_subdomains and a max_age of at least 31536000")
+	}
+	return nil
+}
+
+// Header returns the Strict-Transport-Security value.
+func (h *HSTS) Header() string {
+	value := "max-age=" + strconv.Itoa(h.MaxAge)
+	if h.IncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if h.Preload {
+		value += "; preload"
+	}
+	return value
+}
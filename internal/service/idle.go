@@ -0,0 +1,55 @@
+package service
+
+import (
+	"time"
+)
+
+// Acquire marks a request or connection to the service as active, cancelling any idle
+// countdown. Every Acquire must be paired with a Release.
+func (state *ServiceState) Acquire() {
+	state.Mu.Lock()
+	defer state.Mu.Unlock()
+
+	state.active++
+	state.LastUsed = time.Now()
+	if state.Timer != nil {
+		state.Timer.Stop()
+		state.Timer = nil
+	}
+}
+
+// Release marks a request or connection as finished. Once none are active, the service is
+// stopped after its timeout unless another one arrives first.
+func (state *ServiceState) Release() {
+	state.Mu.Lock()
+	defer state.Mu.Unlock()
+
+	state.active--
+	state.LastUsed = time.Now()
+	if state.active > 0 || state.Service.Timeout <= 0 {
+		return
+	}
+
+	if state.Timer != nil {
+		state.Timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(state.Service.Timeout)*time.Second, func() {
+		state.Mu.Lock()
+		idle := state.Timer == timer && state.active == 0
+		state.Timer = nil
+		state.Mu.Unlock()
+
+		if idle {
+			state.Stop()
+		}
+	})
+	state.Timer = timer
+}
+
+// ActiveConnections returns the number of requests and connections currently in flight.
+func (state *ServiceState) ActiveConnections() int {
+	state.Mu.Lock()
+	defer state.Mu.Unlock()
+	return state.active
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type LogLine struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"` // "stdout" or "stderr"
+	Text   string    `json:"text"`
+}
+
+// LogBuffer keeps the most recent lines written by a service, optionally teeing them
+// to a rotating log file.
+type LogBuffer struct {
+	mu          sync.Mutex
+	name        string
+	lines       []LogLine // ring buffer
+	next        int       // index the next line is written to
+	full        bool
+	counter     int64
+	subscribers map[int64]chan LogLine
+	file        *rotatingFile
+}
+
+func NewLogBuffer(name string, svc *Service) *LogBuffer {
+	size := svc.LogLines
+	if size <= 0 {
+		size = 1000
+	}
+	b := &LogBuffer{
+		name:        name,
+		lines:       make([]LogLine, size),
+		subscribers: make(map[int64]chan LogLine),
+	}
+	if svc.LogFile != "" {
+		maxSize := int64(svc.LogMaxSize)
+		if maxSize <= 0 {
+			maxSize = 10
+		}
+		maxFiles := svc.LogMaxFiles
+		if maxFiles <= 0 {
+			maxFiles = 3
+		}
+		b.file = &rotatingFile{
+			path:     svc.LogFile,
+			maxSize:  maxSize * 1024 * 1024,
+			maxFiles: maxFiles,
+		}
+	}
+	return b
+}
+
+func (b *LogBuffer) append(line LogLine) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lines[b.next] = line
+	b.next = (b.next + 1) % len(b.lines)
+	if b.next == 0 {
+		b.full = true
+	}
+
+	if b.file != nil {
+		fmt.Fprintf(b.file, "%s [%s] %s\n", line.Time.Format(time.RFC3339), line.Stream, line.Text)
+	}
+
+	for _, ch := range b.subscribers {
+		// Use a non-blocking send to avoid blocking if a receiver is slow
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// Tail returns up to n of the most recent lines, oldest first. n <= 0 returns all lines.
+func (b *LogBuffer) Tail(n int) []LogLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	count := b.next
+	if b.full {
+		count = len(b.lines)
+	}
+	if n <= 0 || n > count {
+		n = count
+	}
+
+	result := make([]LogLine, 0, n)
+	for i := count - n; i < count; i++ {
+		idx := i
+		if b.full {
+			idx = (b.next + i) % len(b.lines)
+		}
+		result = append(result, b.lines[idx])
+	}
+	return result
+}
+
+// Follow returns the last n lines along with a channel receiving every line appended
+// afterwards. Call Unfollow with the returned id when done.
+func (b *LogBuffer) Follow(n int) (int64, []LogLine, <-chan LogLine) {
+	tail := b.Tail(n)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.counter
+	b.counter += 1
+	ch := make(chan LogLine, 100)
+	b.subscribers[id] = ch
+	return id, tail, ch
+}
+
+func (b *LogBuffer) Unfollow(id int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ch, ok := b.subscribers[id]; ok {
+		close(ch)
+		delete(b.subscribers, id)
+	}
+}
+
+func (b *LogBuffer) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, ch := range b.subscribers {
+		close(ch)
+		delete(b.subscribers, id)
+	}
+	if b.file != nil {
+		b.file.Close()
+	}
+}
+
+// Writer returns a writer which splits its input into lines for the given stream. Each
+// line is also echoed, labeled with the service name, to echo.
+func (b *LogBuffer) Writer(stream string, echo io.Writer) io.Writer {
+	return &lineWriter{buffer: b, stream: stream, echo: echo}
+}
+
+type lineWriter struct {
+	buffer  *LogBuffer
+	stream  string
+	echo    io.Writer
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		text := string(bytes.TrimSuffix(w.partial[:i], []byte("\r")))
+		w.partial = w.partial[i+1:]
+
+		w.buffer.append(LogLine{Time: time.Now(), Stream: w.stream, Text: text})
+		if w.echo != nil {
+			fmt.Fprintf(w.echo, "[%s] %s\n", w.buffer.name, text)
+		}
+	}
+	return len(p), nil
+}
+
+// rotatingFile appends to path, renaming it to path.1, path.2, ... once it grows past
+// maxSize and keeping at most maxFiles of the rotated files.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Printf("Failed to open log file %s: %v", f.path, err)
+			return 0, err
+		}
+		info, err := file.Stat()
+		if err == nil {
+			f.size = info.Size()
+		}
+		f.file = file
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if f.size >= f.maxSize {
+		f.rotate()
+	}
+	return n, err
+}
+
+func (f *rotatingFile) rotate() {
+	f.Close()
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		log.Printf("Failed to rotate log file %s: %v", f.path, err)
+	}
+}
+
+func (f *rotatingFile) Close() {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+		f.size = 0
+	}
+}
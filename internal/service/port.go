@@ -0,0 +1,78 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const PortAuto = "auto"
+
+// ValidatePort checks that port is empty, "auto" or a valid port number.
+func ValidatePort(port string) error {
+	if port == "" || port == PortAuto {
+		return nil
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("port must be \"auto\" or a number between 1 and 65535")
+	}
+	return nil
+}
+
+// allocatePort asks the kernel for a free TCP port on the loopback interface.
+func allocatePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("allocating port: %w", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// expandPort replaces $<PORT> in s. It is a no-op if no port is assigned.
+func expandPort(s string, port int) string {
+	if port == 0 {
+		return s
+	}
+	return strings.ReplaceAll(s, "$<PORT>", strconv.Itoa(port))
+}
+
+func expandPortAll(args []string, port int) []string {
+	if port == 0 || args == nil {
+		return args
+	}
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		expanded[i] = expandPort(arg, port)
+	}
+	return expanded
+}
+
+// unlockedAssignPort picks the port for the next start: a fresh free port for
+// "port: auto", or the configured number.
+func (state *ServiceState) unlockedAssignPort() error {
+	switch state.Service.Port {
+	case "":
+		state.port.Store(0)
+	case PortAuto:
+		port, err := allocatePort()
+		if err != nil {
+			return err
+		}
+		state.port.Store(int32(port))
+	default:
+		port, err := strconv.Atoi(state.Service.Port)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", state.Service.Port)
+		}
+		state.port.Store(int32(port))
+	}
+	return nil
+}
+
+// Port returns the port assigned to the service, or 0 if it has none.
+func (state *ServiceState) Port() int {
+	return int(state.port.Load())
+}
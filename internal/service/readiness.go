@@ -0,0 +1,219 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type HTTPProbe struct {
+	Path    string            `yaml:"path"`    // defaults to "/"
+	Status  []string          `yaml:"status"`  // codes or ranges such as "200-399", defaults to 2xx
+	Headers map[string]string `yaml:"headers"` // extra request headers
+}
+
+type Readiness struct {
+	// at most one of these may be set, defaults to an HTTP probe against forwards_to
+	HTTP *HTTPProbe `yaml:"http"`
+	TCP  string     `yaml:"tcp"`  // address to connect to, e.g. "127.0.0.1:5432"
+	Unix string     `yaml:"unix"` // socket path to connect to
+	Exec []string   `yaml:"exec"` // command that must exit with status 0
+
+	Interval     int `yaml:"interval"`      // in seconds, defaults to 1
+	InitialDelay int `yaml:"initial_delay"` // in seconds, defaults to 0
+	Deadline     int `yaml:"deadline"`      // in seconds, defaults to 10
+}
+
+type statusRange struct {
+	min, max int
+}
+
+func parseStatusRanges(specs []string) ([]statusRange, error) {
+	if len(specs) == 0 {
+		return []statusRange{{200, 299}}, nil
+	}
+	ranges := make([]statusRange, 0, len(specs))
+	for _, spec := range specs {
+		lo, hi, isRange := strings.Cut(spec, "-")
+		min, err := strconv.Atoi(strings.TrimSpace(lo))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q", spec)
+		}
+		max := min
+		if isRange {
+			max, err = strconv.Atoi(strings.TrimSpace(hi))
+			if err != nil || max < min {
+				return nil, fmt.Errorf("invalid status range %q", spec)
+			}
+		}
+		ranges = append(ranges, statusRange{min, max})
+	}
+	return ranges, nil
+}
+
+func (r *Readiness) Validate() error {
+	probes := 0
+	if r.HTTP != nil {
+		probes++
+		if _, err := parseStatusRanges(r.HTTP.Status); err != nil {
+			return err
+		}
+	}
+	if r.TCP != "" {
+		probes++
+	}
+	if r.Unix != "" {
+		probes++
+	}
+	if len(r.Exec) > 0 {
+		probes++
+	}
+	if probes > 1 {
+		return fmt.Errorf("only one of http, tcp, unix or exec may be set")
+	}
+	if r.Interval < 0 || r.InitialDelay < 0 || r.Deadline < 0 {
+		return fmt.Errorf("interval, initial_delay and deadline must not be negative")
+	}
+	return nil
+}
+
+// expandPort returns a copy of r with $<PORT> substituted in its probe targets.
+func (r *Readiness) expandPort(port int) *Readiness {
+	expanded := *r
+	if r.HTTP != nil {
+		probe := *r.HTTP
+		probe.Path = expandPort(probe.Path, port)
+		expanded.HTTP = &probe
+	}
+	expanded.TCP = expandPort(r.TCP, port)
+	expanded.Unix = expandPort(r.Unix, port)
+	expanded.Exec = expandPortAll(r.Exec, port)
+	return &expanded
+}
+
+func (r *Readiness) interval() time.Duration {
+	if r.Interval > 0 {
+		return time.Duration(r.Interval) * time.Second
+	}
+	return 1 * time.Second
+}
+
+func (r *Readiness) deadline() time.Duration {
+	if r.Deadline > 0 {
+		return time.Duration(r.Deadline) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// probe makes a single readiness check, returning nil if the service is ready.
+func (r *Readiness) probe(ctx context.Context, forwardsTo string) error {
+	switch {
+	case r.TCP != "":
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", r.TCP)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case r.Unix != "":
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "unix", r.Unix)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case len(r.Exec) > 0:
+		return exec.CommandContext(ctx, r.Exec[0], r.Exec[1:]...).Run()
+	default:
+		return r.probeHTTP(ctx, forwardsTo)
+	}
+}
+
+func (r *Readiness) probeHTTP(ctx context.Context, forwardsTo string) error {
+	probe := r.HTTP
+	if probe == nil {
+		probe = &HTTPProbe{}
+	}
+
+	target := strings.TrimSuffix(forwardsTo, "/")
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		target = "http://" + target
+	}
+	path := probe.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target+path, nil)
+	if err != nil {
+		return fmt.Errorf("building probe request: %w", err)
+	}
+	for key, value := range probe.Headers {
+		req.Header.Set(key, value)
+	}
+
+	// readiness should reflect the service itself, not wherever it redirects to
+	client := http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	ranges, err := parseStatusRanges(probe.Status)
+	if err != nil {
+		return err
+	}
+	for _, rng := range ranges {
+		if resp.StatusCode >= rng.min && resp.StatusCode <= rng.max {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected status %d", resp.StatusCode)
+}
+
+// Wait probes until the service is ready, the deadline passes or ctx is cancelled.
+func (r *Readiness) Wait(ctx context.Context, forwardsTo string) error {
+	ctx, cancel := context.WithTimeout(ctx, r.deadline())
+	defer cancel()
+
+	if r.InitialDelay > 0 {
+		select {
+		case <-time.After(time.Duration(r.InitialDelay) * time.Second):
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return ctx.Err()
+			}
+			return fmt.Errorf("service did not start in time")
+		}
+	}
+
+	var lastErr error
+	for {
+		attemptCtx, attemptCancel := context.WithTimeout(ctx, r.interval())
+		lastErr = r.probe(attemptCtx, forwardsTo)
+		attemptCancel()
+		if lastErr == nil {
+			return nil
+		}
+
+		select {
+		case <-time.After(r.interval()):
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.Canceled) {
+				return ctx.Err()
+			}
+			return fmt.Errorf("service did not start in time: %w", lastErr)
+		}
+	}
+}
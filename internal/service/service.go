@@ -1,5 +1,11 @@
 package service
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
 type ServiceType int
 
 const (
@@ -10,25 +16,68 @@ const (
 )
 
 type Service struct {
-	Subdomain string `yaml:"subdomain"`
-	Hidden    bool   `yaml:"hidden"`
+	Subdomain   string `yaml:"subdomain"`
+	PathPrefix  string `yaml:"path_prefix"`  // only route requests under this path, longest prefix wins
+	StripPrefix bool   `yaml:"strip_prefix"` // remove path_prefix from the path before handling
+	Hidden      bool   `yaml:"hidden"`
+
+	ServeFiles string    `yaml:"serve_files"`
+	ForwardsTo Upstreams `yaml:"forwards_to"` // one target or a list of replicas, may contain $<PORT>
+	API        bool      `yaml:"api"`
+
+	LoadBalance *LoadBalance     `yaml:"load_balance"` // how requests are spread over multiple forwards_to
+	Transport   *TransportConfig `yaml:"transport"`    // connection pooling and timeouts towards forwards_to
+
+	Headers      Headers `yaml:"headers"`       // extra request and response headers when proxying
+	PreserveHost bool    `yaml:"preserve_host"` // send the client's Host instead of "localhost"
+
+	Allowlist []string `yaml:"allowlist"` // checked after the global allowlist and blocklist
+	Blocklist []string `yaml:"blocklist"`
+	Auth      *Auth    `yaml:"auth"`
 
-	ServeFiles string `yaml:"serve_files"`
-	ForwardsTo string `yaml:"forwards_to"`
-	API        bool   `yaml:"api"`
+	RedirectHTTPS *bool `yaml:"redirect_https"` // overrides the global redirect_https
+	HSTS          *HSTS `yaml:"hsts"`           // overrides the global hsts
+
+	Port string `yaml:"port"` // "auto" or a port number, substituted for $<PORT> and exported as PORT
 
 	Autostart   bool     `yaml:"autostart"`
+	DependsOn   []string `yaml:"depends_on"` // services started (and ready) before this one
 	Start       []string `yaml:"start"`
 	Stop        []string `yaml:"stop"`
 	Timeout     int      `yaml:"timeout"`
 	KillTimeout int      `yaml:"kill_timeout"`
+
+	StartQueueLimit   int `yaml:"start_queue_limit"`   // max requests waiting on a start in progress, 0 for unlimited
+	StartQueueTimeout int `yaml:"start_queue_timeout"` // in seconds, max time a request waits on a start in progress
+
+	LoadingPage     bool   `yaml:"loading_page"`      // show a loading page to browsers while starting
+	LoadingPageFile string `yaml:"loading_page_file"` // optional custom page, relative to the config's workdir
+
+	// applied to both start and stop commands
+	Env     map[string]string `yaml:"env"`
+	EnvFile string            `yaml:"env_file"` // dotenv file, relative to the config's workdir
+	WorkDir string            `yaml:"workdir"`  // relative to the config's workdir
+	User    string            `yaml:"user"`
+	Group   string            `yaml:"group"`
+
+	LogLines    int    `yaml:"log_lines"`     // recent output lines kept in memory, defaults to 1000
+	LogFile     string `yaml:"log_file"`      // optional, relative to the config's workdir
+	LogMaxSize  int    `yaml:"log_max_size"`  // in megabytes, rotate log_file past this size, defaults to 10
+	LogMaxFiles int    `yaml:"log_max_files"` // rotated log files to keep, defaults to 3
+
+	Readiness *Readiness `yaml:"readiness"`
+
+	Restart        string `yaml:"restart"`         // "never" (default), "on-failure" or "always"
+	RestartBackoff int    `yaml:"restart_backoff"` // in seconds, doubled after each restart in the window
+	MaxRestarts    int    `yaml:"max_restarts"`    // give up after this many restarts in the window, 0 for unlimited
+	RestartWindow  int    `yaml:"restart_window"`  // in seconds, defaults to 60
 }
 
 func (s *Service) Type() ServiceType {
 	if s.ServeFiles != "" {
 		return ServiceTypeFiles
 	}
-	if s.ForwardsTo != "" {
+	if len(s.ForwardsTo) > 0 {
 		return ServiceTypeProxy
 	}
 	if s.API {
@@ -43,10 +92,53 @@ type NamedService struct {
 	Svc  *Service
 }
 
-func MakeServicesBySubdomain(services map[string]*Service) map[string]NamedService {
-	servicesBySubdomain := make(map[string]NamedService)
+// MakeServicesBySubdomain groups services by subdomain, each group sorted by path prefix,
+// longest first. Two services with the same subdomain and path prefix are an error.
+func MakeServicesBySubdomain(services map[string]*Service) (map[string][]NamedService, error) {
+	servicesBySubdomain := make(map[string][]NamedService)
 	for name, svc := range services {
-		servicesBySubdomain[svc.Subdomain] = NamedService{Name: name, Svc: svc}
+		for _, other := range servicesBySubdomain[svc.Subdomain] {
+			if other.Svc.PathPrefix == svc.PathPrefix {
+				first, second := other.Name, name
+				if first > second {
+					first, second = second, first
+				}
+				return nil, fmt.Errorf("services %s and %s both route subdomain %q with path prefix %q",
+					first, second, svc.Subdomain, svc.PathPrefix)
+			}
+		}
+		servicesBySubdomain[svc.Subdomain] = append(servicesBySubdomain[svc.Subdomain], NamedService{Name: name, Svc: svc})
+	}
+	for _, routes := range servicesBySubdomain {
+		sort.Slice(routes, func(i, j int) bool {
+			return len(routes[i].Svc.PathPrefix) > len(routes[j].Svc.PathPrefix)
+		})
+	}
+	return servicesBySubdomain, nil
+}
+
+// NormalizePathPrefix returns prefix with a leading slash and no trailing slash, or "/"
+// if it is empty.
+func NormalizePathPrefix(prefix string) string {
+	return "/" + strings.Trim(prefix, "/")
+}
+
+// MatchesPath reports whether path falls under the service's path prefix.
+func (s *Service) MatchesPath(path string) bool {
+	prefix := s.PathPrefix
+	if prefix == "" || prefix == "/" {
+		return true
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// MatchRoute returns the service with the longest path prefix matching path. routes must
+// come from MakeServicesBySubdomain.
+func MatchRoute(routes []NamedService, path string) (NamedService, bool) {
+	for _, route := range routes {
+		if route.Svc.MatchesPath(path) {
+			return route, true
+		}
 	}
-	return servicesBySubdomain
+	return NamedService{}, false
 }
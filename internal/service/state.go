@@ -1,19 +1,55 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"os/exec"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"serveroute/internal/event"
 )
 
+// Phase is the lifecycle phase of a managed process:
+// stopped -> starting -> running -> stopping -> stopped.
+type Phase int32
+
+const (
+	PhaseStopped Phase = iota
+	PhaseStarting
+	PhaseRunning
+	PhaseStopping
+)
+
+func (p Phase) String() string {
+	switch p {
+	case PhaseStarting:
+		return "starting"
+	case PhaseRunning:
+		return "running"
+	case PhaseStopping:
+		return "stopping"
+	default:
+		return "stopped"
+	}
+}
+
+var (
+	ErrStartQueueFull    = errors.New("too many requests waiting for service to start")
+	ErrStartQueueTimeout = errors.New("timed out waiting for service to start")
+)
+
+// startAttempt is shared by every caller of Start while the service is starting.
+type startAttempt struct {
+	done   chan struct{} // closed once the attempt finishes
+	err    error         // result of the attempt, only read after done is closed
+	cancel context.CancelFunc
+}
+
 type ServiceState struct {
 	Mu       sync.Mutex // global mutex, all methods should lock unless prefixed by "unlocked"
 	EventBus *event.EventBus
@@ -21,84 +57,267 @@ type ServiceState struct {
 	Service  *Service
 	Cmd      *exec.Cmd
 	LastUsed time.Time
-	Timer    *time.Timer
+	Timer    *time.Timer // idle timeout, only armed while no connections are active
+	Logs     *LogBuffer
+
+	phase           atomic.Int32             // a Phase, written under Mu but readable without it
+	port            atomic.Int32             // port substituted for $<PORT>, readable without Mu
+	attempt         *startAttempt            // set while starting
+	waiters         int                      // callers waiting on attempt
+	active          int                      // in-flight requests and connections, see Acquire
+	balancer        atomic.Pointer[Balancer] // written under Mu but readable without it
+	balancerTargets []string
+	exited          chan struct{} // closed by the supervisor once Cmd has exited
+	stopping        bool          // set while Cmd is being torn down, so its exit is not a crash
+	restarts        []time.Time   // restarts within the current restart window
+	restartTimer    *time.Timer
+	startErr        error // why the last start failed, see TakeStartError
+}
+
+func (state *ServiceState) Phase() Phase {
+	return Phase(state.phase.Load())
+}
+
+func (state *ServiceState) unlockedSetPhase(phase Phase) {
+	state.phase.Store(int32(phase))
 }
 
+// Start starts the service and waits until it is ready. Concurrent callers share a
+// single start attempt and its result.
 func (state *ServiceState) Start() error {
-	if state.IsRunning() {
-		return nil
+	err := state.start()
+	state.RecordStartError(err)
+	return err
+}
+
+// RecordStartError sets the error TakeStartError returns, for failures outside of Start
+// such as a dependency that did not start. A nil err clears it.
+func (state *ServiceState) RecordStartError(err error) {
+	if errors.Is(err, ErrStartQueueFull) || errors.Is(err, ErrStartQueueTimeout) {
+		// says nothing about the attempt itself
+		return
 	}
+	state.Mu.Lock()
+	defer state.Mu.Unlock()
+	state.startErr = err
+}
 
+// TakeStartError returns why the last start failed, or nil if it succeeded, and clears
+// it so the failure is reported once.
+func (state *ServiceState) TakeStartError() error {
 	state.Mu.Lock()
 	defer state.Mu.Unlock()
+	err := state.startErr
+	state.startErr = nil
+	return err
+}
+
+func (state *ServiceState) start() error {
+	if state.Service.Type() != ServiceTypeProxy {
+		return nil
+	}
+
+	state.Mu.Lock()
+
+	switch state.Phase() {
+	case PhaseRunning:
+		state.Mu.Unlock()
+		return nil
+	case PhaseStarting:
+		return state.unlockedJoinStart()
+	}
+
+	if err := state.unlockedAssignPort(); err != nil {
+		state.Mu.Unlock()
+		return fmt.Errorf("starting service: %w", err)
+	}
+	if err := state.unlockedBuildBalancer(); err != nil {
+		state.Mu.Unlock()
+		return fmt.Errorf("starting service: %w", err)
+	}
 
 	if len(state.Service.Start) == 0 {
+		// managed elsewhere, assume it is up
+		state.unlockedSetPhase(PhaseRunning)
+		state.Mu.Unlock()
 		return nil
 	}
 
-	log.Printf("Starting service %s: %v", state.Name, state.Service.Start)
+	log.Printf("Starting service %s: %v", state.Name, expandPortAll(state.Service.Start, state.Port()))
 
-	cmd := exec.Command(state.Service.Start[0], state.Service.Start[1:]...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd, err := state.unlockedCommand(state.Service.Start)
+	if err != nil {
+		state.Mu.Unlock()
+		return fmt.Errorf("starting service: %w", err)
+	}
 
 	if err := cmd.Start(); err != nil {
+		state.Mu.Unlock()
 		return fmt.Errorf("starting service: %w", err)
 	}
 
 	state.Cmd = cmd
+	state.exited = make(chan struct{})
+	go state.supervise(cmd, state.exited)
 
-	if err := state.unlockedWaitForService(); err != nil {
-		return err
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	attempt := &startAttempt{
+		done:   make(chan struct{}),
+		cancel: cancel,
 	}
+	state.attempt = attempt
+	state.unlockedSetPhase(PhaseStarting)
+	exited := state.exited
+	state.Mu.Unlock()
 
-	if state.EventBus != nil {
-		state.EventBus.Publish(event.Event{
-			Type:    "start",
-			Service: state.Name,
-		})
+	// other callers join the attempt while we wait
+	err = state.waitForService(ctx, exited)
+
+	state.Mu.Lock()
+	defer state.Mu.Unlock()
+
+	state.attempt = nil
+	if err != nil {
+		log.Printf("Service %s failed to start: %v", state.Name, err)
+		if state.Cmd == cmd {
+			state.unlockedKill()
+		}
+		state.unlockedSetPhase(PhaseStopped)
+	} else {
+		state.unlockedSetPhase(PhaseRunning)
+		if state.EventBus != nil {
+			state.EventBus.Publish(event.Event{
+				Type:    "start",
+				Service: state.Name,
+			})
+		}
 	}
-	return nil
+
+	attempt.err = err
+	close(attempt.done)
+	return err
 }
 
-func (state *ServiceState) unlockedWaitForService() error {
-	target := state.Service.ForwardsTo
-	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
-		target = "http://" + target
+// unlockedJoinStart waits for the start attempt in progress. It must be called with Mu
+// held, and releases it.
+func (state *ServiceState) unlockedJoinStart() error {
+	limit := state.Service.StartQueueLimit
+	if limit > 0 && state.waiters >= limit {
+		state.Mu.Unlock()
+		return ErrStartQueueFull
 	}
 
-	url, err := url.Parse(target)
-	if err != nil {
-		return fmt.Errorf("parsing target URL: %w", err)
+	attempt := state.attempt
+	queueTimeout := state.Service.StartQueueTimeout
+	state.waiters++
+	state.Mu.Unlock()
+
+	defer func() {
+		state.Mu.Lock()
+		state.waiters--
+		state.Mu.Unlock()
+	}()
+
+	var timeout <-chan time.Time
+	if queueTimeout > 0 {
+		timer := time.NewTimer(time.Duration(queueTimeout) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
-	maxRetries := 10
-	for i := 0; i < maxRetries; i++ {
-		resp, err := http.Get(url.String() + "/")
-		if err == nil {
-			resp.Body.Close()
-			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-				return nil
-			}
+	select {
+	case <-attempt.done:
+		return attempt.err
+	case <-timeout:
+		return ErrStartQueueTimeout
+	}
+}
+
+func (state *ServiceState) waitForService(ctx context.Context, exited chan struct{}) error {
+	state.Mu.Lock()
+	readiness := state.Service.Readiness
+	forwardsTo := state.Service.ForwardsTo.First()
+	state.Mu.Unlock()
+
+	if readiness == nil {
+		if forwardsTo == "" {
+			// nothing to probe
+			return nil
 		}
-		time.Sleep(1 * time.Second)
+		readiness = &Readiness{}
 	}
-	return fmt.Errorf("service did not start in time")
+
+	// stop probing early if the process dies before becoming ready
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-exited:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	port := state.Port()
+	if err := readiness.expandPort(port).Wait(ctx, expandPort(forwardsTo, port)); err != nil {
+		select {
+		case <-exited:
+			return fmt.Errorf("service exited before becoming ready")
+		default:
+			return err
+		}
+	}
+	return nil
 }
 
+// Stop stops the service, cancelling a start in progress first.
 func (state *ServiceState) Stop() {
 	state.Mu.Lock()
 	defer state.Mu.Unlock()
 
+	if state.restartTimer != nil {
+		state.restartTimer.Stop()
+		state.restartTimer = nil
+	}
+
+	if attempt := state.attempt; attempt != nil {
+		attempt.cancel()
+		state.Mu.Unlock()
+		<-attempt.done
+		state.Mu.Lock()
+	}
+
 	if state.Cmd == nil || state.Cmd.Process == nil {
+		state.unlockedSetPhase(PhaseStopped)
 		return
 	}
 
 	log.Printf("Stopping service %s", state.Name)
+	state.unlockedSetPhase(PhaseStopping)
+	state.unlockedKill()
+	state.unlockedSetPhase(PhaseStopped)
+
+	if state.EventBus != nil {
+		state.EventBus.Publish(event.Event{
+			Type:    "stop",
+			Service: state.Name,
+		})
+	}
+}
+
+// unlockedKill tears down Cmd with the stop command or signals and waits for it to exit.
+func (state *ServiceState) unlockedKill() {
+	state.stopping = true
 
 	if len(state.Service.Stop) > 0 {
-		cmd := exec.Command(state.Service.Stop[0], state.Service.Stop[1:]...)
-		cmd.Run()
+		cmd, err := state.unlockedCommand(state.Service.Stop)
+		if err == nil {
+			err = cmd.Run()
+		}
+		if err != nil {
+			log.Printf("Stop command for service %s failed: %v", state.Name, err)
+		}
 	} else if state.Service.KillTimeout > 0 {
 		// Try graceful shutdown first
 		if err := state.Cmd.Process.Signal(os.Interrupt); err != nil {
@@ -106,17 +325,11 @@ func (state *ServiceState) Stop() {
 			state.Cmd.Process.Kill()
 		} else {
 			// Wait for process to exit or timeout
-			done := make(chan error, 1)
-			go func() {
-				done <- state.Cmd.Wait()
-			}()
-
 			select {
 			case <-time.After(time.Duration(state.Service.KillTimeout) * time.Second):
 				log.Printf("Service %s shutdown timeout, killing process", state.Name)
 				state.Cmd.Process.Kill()
-				<-done // Wait for process to be killed
-			case <-done:
+			case <-state.exited:
 				// Process exited normally
 			}
 		}
@@ -124,27 +337,26 @@ func (state *ServiceState) Stop() {
 		state.Cmd.Process.Kill()
 	}
 
-	if state.Cmd != nil && state.Cmd.ProcessState == nil {
-		state.Cmd.Wait()
-	}
+	// the supervisor reaps the process
+	<-state.exited
 	state.Cmd = nil
-
-	if state.EventBus != nil {
-		state.EventBus.Publish(event.Event{
-			Type:    "stop",
-			Service: state.Name,
-		})
-	}
+	state.exited = nil
+	state.stopping = false
 }
 
 func (state *ServiceState) IsRunning() bool {
-	state.Mu.Lock()
-	defer state.Mu.Unlock()
-
 	switch state.Service.Type() {
 	case ServiceTypeProxy:
-		return state.Cmd != nil && state.Cmd.Process != nil && state.Cmd.ProcessState == nil
+		return state.Phase() == PhaseRunning
 	default:
 		return true
 	}
 }
+
+// Status returns "stopped", "starting", "ready" or "stopping". It never blocks.
+func (state *ServiceState) Status() string {
+	if state.IsRunning() {
+		return "ready"
+	}
+	return state.Phase().String()
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"log"
+	"os/exec"
+	"time"
+
+	"serveroute/internal/event"
+)
+
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+const maxRestartBackoff = 5 * time.Minute
+
+// supervise reaps cmd once it exits. Unless the exit was requested by Stop, it publishes
+// an "exit" or "crash" event and schedules a restart according to the restart policy.
+func (state *ServiceState) supervise(cmd *exec.Cmd, exited chan struct{}) {
+	cmd.Wait()
+	close(exited)
+
+	state.Mu.Lock()
+	defer state.Mu.Unlock()
+
+	if state.Cmd != cmd || state.stopping {
+		return
+	}
+	state.Cmd = nil
+	state.exited = nil
+	if state.Phase() == PhaseRunning {
+		// a start in progress notices the exit itself
+		state.unlockedSetPhase(PhaseStopped)
+	}
+
+	exitCode := cmd.ProcessState.ExitCode()
+	eventType := "exit"
+	if !cmd.ProcessState.Success() {
+		eventType = "crash"
+	}
+	log.Printf("Service %s exited unexpectedly: %v", state.Name, cmd.ProcessState)
+
+	if state.EventBus != nil {
+		state.EventBus.Publish(event.Event{
+			Type:     eventType,
+			Service:  state.Name,
+			ExitCode: &exitCode,
+		})
+	}
+
+	switch state.Service.Restart {
+	case RestartAlways:
+	case RestartOnFailure:
+		if eventType != "crash" {
+			return
+		}
+	default:
+		return
+	}
+
+	delay, ok := state.unlockedNextRestartDelay()
+	if !ok {
+		log.Printf("Service %s restarted too often, giving up", state.Name)
+		return
+	}
+
+	log.Printf("Restarting service %s in %v", state.Name, delay)
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		state.Mu.Lock()
+		// Stop clears restartTimer, also when it fires while Stop holds Mu
+		current := state.restartTimer == timer
+		if current {
+			state.restartTimer = nil
+		}
+		state.Mu.Unlock()
+		if !current {
+			return
+		}
+
+		if err := state.Start(); err != nil {
+			log.Printf("Failed to restart service %s: %v", state.Name, err)
+		}
+	})
+	state.restartTimer = timer
+}
+
+// unlockedNextRestartDelay records a restart and returns how long to wait before it,
+// or false if max_restarts has been reached within restart_window.
+func (state *ServiceState) unlockedNextRestartDelay() (time.Duration, bool) {
+	window := 60 * time.Second
+	if state.Service.RestartWindow > 0 {
+		window = time.Duration(state.Service.RestartWindow) * time.Second
+	}
+
+	now := time.Now()
+	recent := state.restarts[:0]
+	for _, t := range state.restarts {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	state.restarts = recent
+
+	if state.Service.MaxRestarts > 0 && len(state.restarts) >= state.Service.MaxRestarts {
+		return 0, false
+	}
+
+	delay := 1 * time.Second
+	if state.Service.RestartBackoff > 0 {
+		delay = time.Duration(state.Service.RestartBackoff) * time.Second
+	}
+	for i := 0; i < len(state.restarts) && delay < maxRestartBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxRestartBackoff)
+
+	state.restarts = append(state.restarts, now)
+	return delay, true
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+type TransportConfig struct {
+	MaxIdleConns          int   `yaml:"max_idle_conns"`          // idle connections kept per upstream, defaults to 32
+	IdleTimeout           int   `yaml:"idle_timeout"`            // in seconds, close idle connections after this long, defaults to 90
+	DialTimeout           int   `yaml:"dial_timeout"`            // in seconds, defaults to 30
+	ResponseHeaderTimeout int   `yaml:"response_header_timeout"` // in seconds, 0 waits forever
+	HTTP2                 *bool `yaml:"http2"`                   // negotiate HTTP/2 with https upstreams, defaults to true
+}
+
+func (t *TransportConfig) Validate() error {
+	if t.MaxIdleConns < 0 || t.IdleTimeout < 0 || t.DialTimeout < 0 || t.ResponseHeaderTimeout < 0 {
+		return fmt.Errorf("values must not be negative")
+	}
+	return nil
+}
+
+// NewTransport returns a transport for a single service's upstreams. It is meant to be
+// kept for the lifetime of the service so its connections are reused.
+func NewTransport(cfg *TransportConfig) *http.Transport {
+	if cfg == nil {
+		cfg = &TransportConfig{}
+	}
+
+	maxIdle := 32
+	if cfg.MaxIdleConns > 0 {
+		maxIdle = cfg.MaxIdleConns
+	}
+	idleTimeout := 90 * time.Second
+	if cfg.IdleTimeout > 0 {
+		idleTimeout = time.Duration(cfg.IdleTimeout) * time.Second
+	}
+	dialTimeout := 30 * time.Second
+	if cfg.DialTimeout > 0 {
+		dialTimeout = time.Duration(cfg.DialTimeout) * time.Second
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   dialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          0, // bounded by MaxIdleConnsPerHost times the number of upstreams
+		MaxIdleConnsPerHost:   maxIdle,
+		IdleConnTimeout:       idleTimeout,
+		ResponseHeaderTimeout: time.Duration(cfg.ResponseHeaderTimeout) * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	if cfg.HTTP2 != nil && !*cfg.HTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		// a non-nil empty map disables the bundled HTTP/2 support
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
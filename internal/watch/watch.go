@@ -0,0 +1,52 @@
+package watch
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+func stat(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size(), exists: true}
+}
+
+// Files polls the given paths every interval and calls onChange whenever any of
+// them is modified, created or removed. It returns when ctx is cancelled.
+func Files(ctx context.Context, interval time.Duration, paths []string, onChange func()) {
+	stamps := make([]fileStamp, len(paths))
+	for i, path := range paths {
+		stamps[i] = stat(path)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed := false
+			for i, path := range paths {
+				stamp := stat(path)
+				if stamp != stamps[i] {
+					stamps[i] = stamp
+					changed = true
+				}
+			}
+			if changed {
+				onChange()
+			}
+		}
+	}
+}
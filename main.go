@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"serveroute/internal/config"
@@ -21,6 +22,12 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	// resolve before changing directory so reloads find the same file
+	absConfigPath, err := filepath.Abs(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to resolve config path: %v", err)
+	}
+
 	log.Printf("Changing directory to %s", cfg.WorkDir)
 	if err := os.Chdir(cfg.WorkDir); err != nil {
 		log.Fatalf("Failed to change to workdir %s: %v", cfg.WorkDir, err)
@@ -36,6 +43,15 @@ func main() {
 	defer stop()
 
 	go server.ServeForever()
+	go server.WatchConfig(ctx, absConfigPath)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			server.ReloadConfig(absConfigPath)
+		}
+	}()
 
 	<-ctx.Done()
 	server.Shutdown()
@@ -1,8 +1,16 @@
 document.addEventListener('DOMContentLoaded', () => {
     const servicesBody = document.getElementById('services-body');
+    const tunnelsSection = document.getElementById('tunnels-section');
+    const tunnelsBody = document.getElementById('tunnels-body');
     const scheme = window.location.protocol;
     const host = window.location.host;
     const apiBase = `${scheme}//api.${host}`;
+    const logsPanel = document.getElementById('logs-panel');
+    const logsTitle = document.getElementById('logs-title');
+    const logsOutput = document.getElementById('logs-output');
+    let logsSource = null;
+
+    document.getElementById('logs-close').addEventListener('click', closeLogs);
 
     // Fetch initial services list
     fetch(`${apiBase}/list`)
@@ -15,6 +23,86 @@ document.addEventListener('DOMContentLoaded', () => {
             console.error('Error fetching services:', error);
         });
 
+    fetchTunnels();
+
+    function fetchTunnels() {
+        fetch(`${apiBase}/tunnels`)
+            .then(response => response.json())
+            .then(renderTunnels)
+            .catch(error => {
+                console.error('Error fetching tunnels:', error);
+            });
+    }
+
+    function renderTunnels(tunnels) {
+        tunnelsBody.innerHTML = '';
+        const names = Object.keys(tunnels).sort();
+        tunnelsSection.hidden = names.length === 0;
+        names.forEach(name => {
+            const tunnel = tunnels[name];
+            const row = document.createElement('tr');
+            row.dataset.altHost = name;
+
+            const statusCell = document.createElement('td');
+            statusCell.className = `status ${tunnel.state}`;
+            statusCell.textContent = tunnel.state;
+
+            const nameCell = document.createElement('td');
+            nameCell.textContent = name;
+
+            // type, uptime, reconnects and the last error
+            const details = [tunnel.type];
+            if (tunnel.connected_since) {
+                details.push(`since ${new Date(tunnel.connected_since).toLocaleString()}`);
+            }
+            if (tunnel.reconnects > 0) {
+                details.push(`${tunnel.reconnects} reconnects`);
+            }
+            const detailsCell = document.createElement('td');
+            detailsCell.textContent = details.join(', ');
+            if (tunnel.last_error) {
+                const error = document.createElement('div');
+                error.className = 'tunnel-error';
+                error.textContent = tunnel.last_error;
+                detailsCell.appendChild(error);
+            }
+
+            const actionsCell = document.createElement('td');
+            actionsCell.className = 'actions';
+
+            const openButton = document.createElement('button');
+            openButton.className = 'start-btn';
+            openButton.textContent = 'Open';
+            openButton.disabled = tunnel.state === 'connected';
+            openButton.addEventListener('click', () => tunnelAction('open', name));
+
+            const closeButton = document.createElement('button');
+            closeButton.className = 'stop-btn';
+            closeButton.textContent = 'Close';
+            closeButton.disabled = tunnel.state === 'closed';
+            closeButton.addEventListener('click', () => tunnelAction('close', name));
+
+            actionsCell.appendChild(openButton);
+            actionsCell.appendChild(closeButton);
+            row.appendChild(statusCell);
+            row.appendChild(nameCell);
+            row.appendChild(detailsCell);
+            row.appendChild(actionsCell);
+
+            tunnelsBody.appendChild(row);
+        });
+    }
+
+    function tunnelAction(action, name) {
+        fetch(`${apiBase}/tunnels/${action}`, {
+            method: 'POST',
+            headers: {
+                'Content-Type': 'application/json'
+            },
+            body: JSON.stringify({ alt_host: name })
+        }).then(fetchTunnels);
+    }
+
     function renderServices(services) {
         servicesBody.innerHTML = '';
         Object.entries(services).forEach(([name, service]) => {
@@ -39,7 +127,7 @@ document.addEventListener('DOMContentLoaded', () => {
             startButton.className = 'start-btn';
             startButton.textContent = 'Start';
             startButton.dataset.name = name;
-            if (service.status === 'started') {
+            if (service.status !== 'stopped') {
                 startButton.disabled = true;
             }
             
@@ -52,9 +140,16 @@ document.addEventListener('DOMContentLoaded', () => {
                 stopButton.disabled = true;
             }
             
+            // Create logs button
+            const logsButton = document.createElement('button');
+            logsButton.className = 'logs-btn';
+            logsButton.textContent = 'Logs';
+            logsButton.dataset.name = name;
+
             // Assemble the row
             actionsCell.appendChild(startButton);
             actionsCell.appendChild(stopButton);
+            actionsCell.appendChild(logsButton);
             row.appendChild(statusCell);
             row.appendChild(nameCell);
             row.appendChild(actionsCell);
@@ -88,6 +183,40 @@ document.addEventListener('DOMContentLoaded', () => {
                 });
             });
         });
+
+        document.querySelectorAll('.logs-btn').forEach(button => {
+            button.addEventListener('click', () => {
+                openLogs(button.dataset.name);
+            });
+        });
+    }
+
+    function openLogs(name) {
+        closeLogs();
+        logsTitle.textContent = `Logs: ${name}`;
+        logsOutput.textContent = '';
+        logsPanel.hidden = false;
+
+        logsSource = new EventSource(`${apiBase}/logs/follow?service=${encodeURIComponent(name)}&tail=200`);
+        logsSource.addEventListener('message', (event) => {
+            const line = JSON.parse(event.data);
+            const span = document.createElement('span');
+            span.className = line.stream;
+            span.textContent = `${new Date(line.time).toLocaleTimeString()} ${line.text}\n`;
+            const atBottom = logsOutput.scrollTop + logsOutput.clientHeight >= logsOutput.scrollHeight - 4;
+            logsOutput.appendChild(span);
+            if (atBottom) {
+                logsOutput.scrollTop = logsOutput.scrollHeight;
+            }
+        });
+    }
+
+    function closeLogs() {
+        if (logsSource) {
+            logsSource.close();
+            logsSource = null;
+        }
+        logsPanel.hidden = true;
     }
 
     function updateServiceStatus(serviceName, status) {
@@ -122,8 +251,10 @@ document.addEventListener('DOMContentLoaded', () => {
             console.log(eventData);
             if (eventData.type === 'start') {
                 updateServiceStatus(eventData.service, 'started');
-            } else if (eventData.type === 'stop') {
+            } else if (['stop', 'exit', 'crash'].includes(eventData.type)) {
                 updateServiceStatus(eventData.service, 'stopped');
+            } else if (['tunnel_open', 'tunnel_close', 'reload'].includes(eventData.type)) {
+                fetchTunnels();
             }
         });
 